@@ -0,0 +1,94 @@
+package dockerdiscovery
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const cnameLabel = "coredns.dockerdiscovery.cname"
+
+// CNAMEResolver sets the names of the cname label, which are answered with a
+// CNAME record to the canonical name of the container
+type CNAMEResolver struct {
+	LabelResolver
+}
+
+// isAliasResolver reports whether the names of the resolver are answered with CNAME records
+func (dd *DockerDiscovery) isAliasResolver(resolver ContainerDomainResolver) bool {
+	switch resolver.(type) {
+	case *CNAMEResolver:
+		return true
+	case *LabelResolver, *NetworkAliasesResolver:
+		return dd.cnameAliases
+	}
+	return false
+}
+
+// canonicalName returns the name the aliases of the container point to: the
+// first domain under ptrDomain when one is configured, the first resolved
+// domain otherwise, skipping aliases and wildcards. It returns "" when the
+// container has no such domain.
+func (dd *DockerDiscovery) canonicalName(containerInfo *ContainerInfo) string {
+	var target string
+	for _, d := range containerInfo.domains {
+		domain := canonicalDomain(d)
+		if strings.HasPrefix(domain, "*.") || containerInfo.aliases[domain] {
+			continue
+		}
+		if dd.ptrDomain == "" || dns.IsSubDomain(dd.ptrDomain, domain) {
+			return domain
+		}
+		if target == "" {
+			target = domain
+		}
+	}
+	return target
+}
+
+// aliasAnswer returns the CNAME record of the name when the containers
+// resolve to it as an alias of their canonical name, with the canonical name
+// and its containers to answer the addresses of. Otherwise it returns the
+// name and the containers unchanged. Replicas with different canonical names
+// are answered directly.
+func (dd *DockerDiscovery) aliasAnswer(name string, containerInfos []*ContainerInfo) ([]dns.RR, string, []*ContainerInfo) {
+	if len(containerInfos) == 0 {
+		return nil, name, containerInfos
+	}
+
+	qname := canonicalDomain(name)
+	dd.mutex.RLock()
+	domain := qname
+	if _, ok := dd.domainMap[domain]; !ok {
+		domain = dd.wildcardDomain(qname)
+	}
+	dd.mutex.RUnlock()
+
+	var target string
+	for _, containerInfo := range containerInfos {
+		if !containerInfo.aliases[domain] {
+			return nil, name, containerInfos
+		}
+		canonical := dd.canonicalName(containerInfo)
+		if canonical == "" || (target != "" && canonical != target) {
+			return nil, name, containerInfos
+		}
+		target = canonical
+	}
+
+	targetInfos, _ := dd.containerInfosByDomain(target)
+	return getCNAMEAnswer(name, target, dd.answerTTL(containerInfos)), target, targetInfos
+}
+
+// getCNAMEAnswer returns the CNAME record of the name to the target
+func getCNAMEAnswer(name string, target string, ttl uint32) []dns.RR {
+	record := new(dns.CNAME)
+	record.Hdr = dns.RR_Header{
+		Name:   name,
+		Rrtype: dns.TypeCNAME,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	record.Target = target
+	return []dns.RR{record}
+}
@@ -1,121 +1,419 @@
 package dockerdiscovery
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/plugin/pkg/fall"
 	"github.com/coredns/coredns/request"
 	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/miekg/dns"
 )
 
+// dockerHost is a docker daemon watched by the plugin
+type dockerHost struct {
+	alias        string // qualifies the container domains when qualifyHosts is enabled
+	endpoint     string
+	tlsCert      string
+	tlsKey       string
+	tlsCA        string
+	internalNets map[string]bool
+	client       *dockerapi.Client
+	hostIPs      []net.IP // answered for the host network containers
+	swarmRecords swarmRecords
+	synced       bool // the containers were loaded at least once
+	connected    bool // the event stream is connected
+	takenOver    bool // the containers were handed over by the previous instance
+}
+
+// newClient creates the docker client of the host. The env endpoint reads
+// DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH from the environment.
+func (host *dockerHost) newClient() (*dockerapi.Client, error) {
+	if host.endpoint == envDockerEndpoint {
+		return dockerapi.NewClientFromEnv()
+	}
+	if host.tlsCert != "" {
+		// the docker client silently skips missing certificate files
+		for _, file := range []string{host.tlsCert, host.tlsKey, host.tlsCA} {
+			if _, err := os.Stat(file); err != nil {
+				return nil, err
+			}
+		}
+		return dockerapi.NewTLSClient(host.endpoint, host.tlsCert, host.tlsKey, host.tlsCA)
+	}
+	return dockerapi.NewClient(host.endpoint)
+}
+
 type ContainerInfo struct {
-	container *dockerapi.Container
-	address   net.IP
-	address6  net.IP
-	domains   []string // resolved domain
+	host          *dockerHost
+	container     *dockerapi.Container
+	address       net.IP
+	address6      net.IP
+	networks      []containerNetwork
+	domains       []string        // resolved domain
+	aliases       map[string]bool // canonical domains answered with a CNAME to the canonical name
+	ttl           uint32          // from the ttl label, the global TTL otherwise
+	resolverNames map[string]int  // number of resolved domains by resolver type
+}
+
+// addresses returns the addresses of the container on all its networks, none
+// for a host network container, which shares the addresses of the docker host
+func (containerInfo *ContainerInfo) addresses() []net.IP {
+	if containerInfo.container.HostConfig != nil && containerInfo.container.HostConfig.NetworkMode == "host" {
+		return nil
+	}
+	var addresses []net.IP
+	for _, address := range []net.IP{containerInfo.address, containerInfo.address6} {
+		if address != nil {
+			addresses = append(addresses, address)
+		}
+	}
+	for _, network := range containerInfo.networks {
+		for _, address := range []net.IP{network.address, network.address6} {
+			if address != nil {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
 }
 
 type ContainerInfoMap map[string]*ContainerInfo
 
+// answer orders of the addresses of containers sharing a name
+const (
+	orderSorted     = "sorted"
+	orderShuffle    = "shuffle"
+	orderRoundRobin = "round_robin"
+)
+
 type ContainerDomainResolver interface {
 	// return domains without trailing dot
 	resolve(container *dockerapi.Container) ([]string, error)
 }
 
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+	swarmResyncInterval = 30 * time.Second
+)
+
 // DockerDiscovery is a plugin that conforms to the coredns plugin interface
 type DockerDiscovery struct {
-	Next           plugin.Handler
-	dockerEndpoint string
-	resolvers      []ContainerDomainResolver
-	dockerClient   *dockerapi.Client
+	Next         plugin.Handler
+	Fall         fall.F
+	hosts        []*dockerHost
+	networkOrder []string // preferred networks of the containers on several networks
+	qualifyHosts bool
+	cnameAliases bool // answer the label and network alias names with CNAME records
+	resolvers    []ContainerDomainResolver
+	rewrites     []rewriteRule
+	hostNetwork  []string // host network addresses: IPs, interfaces or auto
+	publishZones []string // zones answered with the published addresses, "." for all
+	clientSubnet bool     // answer the address on the network of the client
+	subnetOrder  []string // fallback networks when none contains the client
+	filter       containerFilter
 
 	mutex            sync.RWMutex
 	containerInfoMap ContainerInfoMap
+	domainMap        map[string]ContainerInfoMap // canonical domain -> containers resolving to it
+	reverseMap       map[string]ContainerInfoMap // container address -> containers using it
+	nonTerminals     map[string]int              // parent domain -> number of domains below it
+	ptrDomain        string
+	txt              bool     // answer TXT queries with the container metadata
+	txtLabelPrefixes []string // labels exposed in TXT records
+	zones            []string // zones the plugin is authoritative for
+	swarmDomain      string
+	serial           uint32
 	ttl              uint32
+	minTTL           uint32 // bounds of the container ttl labels
+	maxTTL           uint32
+	negativeTTL      uint32
+	order            string
+	rrCounter        uint32
+
+	ctx    context.Context // canceled on shutdown
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // event loops and event handlers
 }
 
 // NewDockerDiscovery constructs a new DockerDiscovery object
 func NewDockerDiscovery(dockerEndpoint string) *DockerDiscovery {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &DockerDiscovery{
-		dockerEndpoint:   dockerEndpoint,
+		hosts:            []*dockerHost{{endpoint: dockerEndpoint}},
 		containerInfoMap: make(ContainerInfoMap),
+		domainMap:        make(map[string]ContainerInfoMap),
+		nonTerminals:     make(map[string]int),
+		reverseMap:       make(map[string]ContainerInfoMap),
 		ttl:              3600,
+		maxTTL:           maxTTL,
+		negativeTTL:      defaultNegativeTTL,
+		serial:           uint32(time.Now().Unix()),
+		order:            orderSorted,
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 }
 
-func (dd *DockerDiscovery) resolveDomainsByContainer(container *dockerapi.Container) ([]string, error) {
+// resolveDomainsByContainer returns the domains of the container, the number
+// of domains by resolver type and the canonical domains answered as aliases
+func (dd *DockerDiscovery) resolveDomainsByContainer(host *dockerHost, container *dockerapi.Container) ([]string, map[string]int, map[string]bool, error) {
 	var domains []string
+	var isAlias []bool
+	resolverNames := make(map[string]int)
 	for _, resolver := range dd.resolvers {
 		var d, err = resolver.resolve(container)
 		if err != nil {
 			log.Printf("[docker] Error resolving container domains %s", err)
 		}
-		domains = append(domains, d...)
+		for _, domain := range d {
+			sanitized, err := sanitizeDomain(rewriteDomain(domain, dd.rewrites))
+			if err != nil {
+				log.Printf("[docker] Skipping domain of container %s: %s", container.ID[:12], err)
+				continue
+			}
+			domains = append(domains, sanitized)
+			isAlias = append(isAlias, dd.isAliasResolver(resolver))
+			resolverNames[resolverType(resolver)]++
+		}
+	}
+
+	if dd.qualifyHosts && host.alias != "" {
+		for i, d := range domains {
+			domains[i] = dd.qualifyDomain(d, host.alias)
+		}
 	}
 
-	return domains, nil
+	aliases := make(map[string]bool)
+	for i, d := range domains {
+		if isAlias[i] {
+			aliases[canonicalDomain(d)] = true
+		}
+	}
+	return domains, resolverNames, aliases, nil
 }
 
-func (dd *DockerDiscovery) containerInfoByDomain(requestName string) (*ContainerInfo, error) {
+// qualifyDomain inserts the host alias before the owned zone of the domain,
+// e.g. web.docker.loc becomes web.hostA.docker.loc. Domains outside the owned
+// zones are returned unchanged.
+func (dd *DockerDiscovery) qualifyDomain(domain string, alias string) string {
+	domain = canonicalDomain(domain)
+	for _, zone := range dd.zones {
+		if domain != zone && dns.IsSubDomain(zone, domain) {
+			return fmt.Sprintf("%s%s.%s", strings.TrimSuffix(domain, zone), alias, zone)
+		}
+	}
+	return domain
+}
+
+// containerInfosByDomain returns all the containers resolving to the name
+func (dd *DockerDiscovery) containerInfosByDomain(requestName string) ([]*ContainerInfo, error) {
 	dd.mutex.RLock()
 	defer dd.mutex.RUnlock()
 
-	for _, containerInfo := range dd.containerInfoMap {
-		for _, d := range containerInfo.domains {
-			if fmt.Sprintf("%s.", d) == requestName { // qualified domain name must be specified with a trailing dot
-				return containerInfo, nil
+	containerInfoMap, ok := dd.domainMap[canonicalDomain(requestName)]
+	if !ok {
+		containerInfoMap = dd.domainMap[dd.wildcardDomain(canonicalDomain(requestName))]
+	}
+
+	var containerInfos []*ContainerInfo
+	for _, containerInfo := range containerInfoMap {
+		containerInfos = append(containerInfos, containerInfo)
+	}
+
+	return containerInfos, nil
+}
+
+// canonicalDomain returns the lower case fully qualified form of the domain
+func canonicalDomain(domain string) string {
+	return strings.ToLower(dns.Fqdn(domain))
+}
+
+// containerAddresses returns the A or AAAA addresses of the containers for
+// the name: their published addresses in published mode, their addresses on
+// the network of the client with client_subnet
+func (dd *DockerDiscovery) containerAddresses(name string, client net.IP, containerInfos []*ContainerInfo, v6 bool) []net.IP {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	var addresses []net.IP
+	for _, containerInfo := range containerInfos {
+		address := dd.clientNetworkAddress(containerInfo, client, v6)
+		if dd.isPublished(name, containerInfo) {
+			if published := publishedAddress(containerInfo.host, containerInfo.container, v6); published != nil {
+				address = published
 			}
 		}
+		if address != nil {
+			addresses = append(addresses, address)
+		}
 	}
+	return addresses
+}
 
-	return nil, nil
+// orderAddresses sorts the addresses, then shuffles or rotates them
+// according to the configured answer order
+func (dd *DockerDiscovery) orderAddresses(addresses []net.IP) []net.IP {
+	sort.Slice(addresses, func(i, j int) bool {
+		return bytes.Compare(addresses[i], addresses[j]) < 0
+	})
+
+	switch dd.order {
+	case orderShuffle:
+		rand.Shuffle(len(addresses), func(i, j int) {
+			addresses[i], addresses[j] = addresses[j], addresses[i]
+		})
+	case orderRoundRobin:
+		if len(addresses) > 1 {
+			shift := int(atomic.AddUint32(&dd.rrCounter, 1) % uint32(len(addresses)))
+			addresses = append(addresses[shift:], addresses[:shift]...)
+		}
+	}
+	return addresses
+}
+
+// containerInfosByAddress returns the containers using the address, sorted by
+// ID. Docker hosts hand out the same bridge addresses, so several endpoints
+// may have a container with the same address.
+func (dd *DockerDiscovery) containerInfosByAddress(address net.IP) []*ContainerInfo {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	var containerInfos []*ContainerInfo
+	for _, containerInfo := range dd.reverseMap[address.String()] {
+		containerInfos = append(containerInfos, containerInfo)
+	}
+	sort.Slice(containerInfos, func(i, j int) bool {
+		return containerInfos[i].container.ID < containerInfos[j].container.ID
+	})
+	return containerInfos
+}
+
+// ptrTarget returns the canonical name of the container, or its first alias
+// when it has none. It returns "" when the container has only wildcard domains.
+func (dd *DockerDiscovery) ptrTarget(containerInfo *ContainerInfo) string {
+	if target := dd.canonicalName(containerInfo); target != "" {
+		return target
+	}
+	for _, d := range containerInfo.domains {
+		if !strings.HasPrefix(d, "*.") {
+			return canonicalDomain(d)
+		}
+	}
+	return ""
 }
 
 // ServeDNS implements plugin.Handler
 func (dd *DockerDiscovery) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
-	var answers []dns.RR
+	subnet := dd.subnetOption(state)
+	client := dd.clientAddress(state, subnet)
+
+	// an alias answers its CNAME record for any type, followed by the
+	// records of the canonical name for A, AAAA and TXT
+	containerInfos, _ := dd.containerInfosByDomain(state.QName())
+	answers, name, containerInfos := dd.aliasAnswer(state.Name(), containerInfos)
+	var extras []dns.RR
+	nodata := false // the name has A records only, see RFC 6147 section 5.1.2
 	switch state.QType() {
 	case dns.TypeA:
-		containerInfo, _ := dd.containerInfoByDomain(state.QName())
-		if containerInfo != nil {
-			answers = getAnswer(state.Name(), []net.IP{containerInfo.address}, dd.ttl, false)
+		addresses := append(dd.containerAddresses(name, client, containerInfos, false), dd.swarmAddresses(name, false)...)
+		if len(addresses) > 0 {
+			answers = append(answers, getAnswer(name, dd.orderAddresses(addresses), dd.answerTTL(containerInfos), false)...)
 		}
 	case dns.TypeAAAA:
-		containerInfo, _ := dd.containerInfoByDomain(state.QName())
-		if containerInfo != nil && containerInfo.address6 != nil {
-			answers = getAnswer(state.Name(), []net.IP{containerInfo.address6}, dd.ttl, true)
-		} else if containerInfo != nil && containerInfo.address != nil {
-			// in acordance with https://tools.ietf.org/html/rfc6147#section-5.1.2 we should return an empty answer section if no AAAA records are available and a A record is available when the client requested AAAA
-			record := new(dns.AAAA)
-			record.Hdr = dns.RR_Header{
-				Name:   state.Name(),
-				Rrtype: dns.TypeAAAA,
-				Class:  dns.ClassINET,
-				Ttl:    dd.ttl,
-				Rdlength: 0,
+		addresses := append(dd.containerAddresses(name, client, containerInfos, true), dd.swarmAddresses(name, true)...)
+		if len(addresses) > 0 {
+			answers = append(answers, getAnswer(name, dd.orderAddresses(addresses), dd.answerTTL(containerInfos), true)...)
+		} else {
+			nodata = len(dd.containerAddresses(name, client, containerInfos, false)) > 0 || len(dd.swarmAddresses(name, false)) > 0
+		}
+	case dns.TypePTR:
+		address := net.ParseIP(dnsutil.ExtractAddressFromReverse(state.Name()))
+		if address == nil {
+			break
+		}
+		containerInfos := dd.containerInfosByAddress(address)
+		ttl := dd.answerTTL(containerInfos)
+		for _, containerInfo := range containerInfos {
+			if target := dd.ptrTarget(containerInfo); target != "" {
+				answers = append(answers, getPTRAnswer(state.Name(), target, ttl)...)
 			}
-			answers = append(answers, record)
+		}
+		answers = dns.Dedup(answers, nil)
+	case dns.TypeTXT:
+		if !dd.txt {
+			break
+		}
+		answers = append(answers, dd.getTXTAnswer(name, containerInfos)...)
+	case dns.TypeSRV:
+		service, proto, name, ok := splitSRVName(state.Name())
+		if !ok || len(answers) > 0 {
+			break
+		}
+		// the target of an SRV record can't be an alias (RFC 2782)
+		containerInfos, _ := dd.containerInfosByDomain(name)
+		_, name, containerInfos = dd.aliasAnswer(name, containerInfos)
+		ttl := dd.answerTTL(containerInfos)
+		for _, containerInfo := range containerInfos {
+			ports := containerSRVPorts(containerInfo.container)
+			if dd.isPublished(name, containerInfo) {
+				ports = publishedSRVPorts(containerInfo.container, ports)
+			}
+			answers = append(answers, getSRVAnswer(state.Name(), name, ports, service, proto, ttl)...)
+		}
+		if len(answers) > 0 {
+			answers = dns.Dedup(answers, nil)
+			extras = append(extras, getAnswer(name, dd.orderAddresses(dd.containerAddresses(name, client, containerInfos, false)), ttl, false)...)
+			extras = append(extras, getAnswer(name, dd.orderAddresses(dd.containerAddresses(name, client, containerInfos, true)), ttl, true)...)
 		}
 	}
 
+	var authority []dns.RR
+	rcode := dns.RcodeSuccess
+	zone := plugin.Zones(dd.zones).Matches(state.Name())
+	result := resultAnswered
 	if len(answers) == 0 {
-		return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+		if !nodata && (zone == "" || dd.Fall.Through(state.Name())) {
+			queries.WithLabelValues(metrics.WithServer(ctx), state.Type(), zone, resultFallthrough).Inc()
+			return plugin.NextOrFailure(dd.Name(), dd.Next, ctx, w, r)
+		}
+		// a name outside of the zones has no SOA record for its NODATA
+		if zone != "" {
+			answers, authority, rcode = dd.zoneAnswer(state, zone)
+		}
+		if len(answers) == 0 {
+			result = resultNegative
+		}
 	}
+	queries.WithLabelValues(metrics.WithServer(ctx), state.Type(), zone, result).Inc()
 
 	m := new(dns.Msg)
-	m.SetReply(r)
+	m.SetRcode(r, rcode)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
 	m.Answer = answers
+	m.Ns = authority
+	m.Extra = extras
 
-	state.SizeAndDo(m)
+	if state.SizeAndDo(m) && subnet != nil {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, scopedSubnetOption(subnet))
+	}
 	m = state.Scrub(m)
 	err := w.WriteMsg(m)
 	if err != nil {
@@ -129,7 +427,7 @@ func (dd *DockerDiscovery) Name() string {
 	return "docker"
 }
 
-func (dd *DockerDiscovery) getContainerAddress(container *dockerapi.Container, v6 bool) (net.IP, error) {
+func (dd *DockerDiscovery) getContainerAddress(host *dockerHost, container *dockerapi.Container, v6 bool) (net.IP, error) {
 
 	// save this away
 	netName, hasNetName := container.Config.Labels["coredns.dockerdiscovery.network"]
@@ -147,17 +445,19 @@ func (dd *DockerDiscovery) getContainerAddress(container *dockerapi.Container, v
 
 		networkMode = container.HostConfig.NetworkMode
 
-		// TODO: Deal with containers run with host ip (--net=host)
 		if networkMode == "host" {
-			log.Println("[docker] Container uses host network")
-			return nil, nil
+			address := hostNetworkAddress(host, v6)
+			if address == nil && !v6 {
+				log.Printf("[docker] Container %s uses host network without a host network address", container.ID[:12])
+			}
+			return address, nil
 		}
 
 		if strings.HasPrefix(networkMode, "container:") {
 			log.Printf("Container %s is in another container's network namspace", container.ID[:12])
 			otherID := container.HostConfig.NetworkMode[len("container:"):]
 			var err error
-			container, err = dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: otherID})
+			container, err = host.client.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: otherID})
 			if err != nil {
 				return nil, err
 			}
@@ -178,6 +478,8 @@ func (dd *DockerDiscovery) getContainerAddress(container *dockerapi.Container, v
 		for netName, network = range container.NetworkSettings.Networks {
 			ok = true
 		}
+	} else {
+		netName, network, ok = dd.preferredNetwork(host, container, networkMode)
 	}
 
 	if !ok { // sometime while "network:disconnect" event fire
@@ -193,34 +495,60 @@ func (dd *DockerDiscovery) getContainerAddress(container *dockerapi.Container, v
 	return nil, nil
 }
 
-func (dd *DockerDiscovery) updateContainerInfo(container *dockerapi.Container) error {
+func (dd *DockerDiscovery) updateContainerInfo(host *dockerHost, container *dockerapi.Container) error {
+	dd.inspectNetworks(host, container)
+
 	dd.mutex.Lock()
 	defer dd.mutex.Unlock()
 
 	_, isExist := dd.containerInfoMap[container.ID]
 	if isExist { // remove previous resolved container info
-		delete(dd.containerInfoMap, container.ID)
+		dd.unindexContainerInfo(container.ID)
+	}
+
+	if !dd.filter.matches(container) {
+		if isExist {
+			log.Printf("[docker] Remove filtered out container entry %s (%s)", normalizeContainerName(container), container.ID[:12])
+		}
+		return nil
 	}
 
-	containerAddress, err := dd.getContainerAddress(container, false)
+	networks := containerNetworks(container)
+	containerAddress, err := dd.getContainerAddress(host, container, false)
+	if containerAddress == nil && dd.clientSubnet {
+		if address := dd.subnetFallbackAddress(networks, false); address != nil {
+			containerAddress, err = address, nil
+		}
+	}
 	if err != nil || containerAddress == nil {
 		log.Printf("[docker] Remove container entry %s (%s)", normalizeContainerName(container), container.ID[:12])
 		return err
 	}
 
-	containerAddress6, err := dd.getContainerAddress(container, true)
+	containerAddress6, _ := dd.getContainerAddress(host, container, true)
+	if containerAddress6 == nil && dd.clientSubnet {
+		containerAddress6 = dd.subnetFallbackAddress(networks, true)
+	}
 
-	domains, _ := dd.resolveDomainsByContainer(container)
+	domains, resolverNames, aliases, _ := dd.resolveDomainsByContainer(host, container)
 	if len(domains) > 0 {
-		dd.containerInfoMap[container.ID] = &ContainerInfo{
-			container: container,
-			address:   containerAddress,
-			address6:  containerAddress6,
-			domains:   domains,
-		}
+		dd.indexContainerInfo(&ContainerInfo{
+			host:          host,
+			container:     container,
+			address:       containerAddress,
+			address6:      containerAddress6,
+			networks:      networks,
+			domains:       domains,
+			aliases:       aliases,
+			ttl:           dd.containerTTL(container),
+			resolverNames: resolverNames,
+		})
 
 		if !isExist {
 			log.Printf("[docker] Add entry of container %s (%s). IP: %v", normalizeContainerName(container), container.ID[:12], containerAddress)
+			if len(dd.hostNetwork) == 0 && container.Config.Labels[publishedLabel] != "" && publishesOnAllInterfaces(container) {
+				log.Printf("[docker] Container %s (%s) publishes ports on all interfaces without host_network_address, its bridge address is answered", normalizeContainerName(container), container.ID[:12])
+			}
 		}
 	} else if isExist {
 		log.Printf("[docker] Remove container entry %s (%s)", normalizeContainerName(container), container.ID[:12])
@@ -238,82 +566,267 @@ func (dd *DockerDiscovery) removeContainerInfo(containerID string) error {
 		return nil
 	}
 	log.Printf("[docker] Deleting entry %s (%s)", normalizeContainerName(containerInfo.container), containerInfo.container.ID[:12])
-	delete(dd.containerInfoMap, containerID)
+	dd.unindexContainerInfo(containerID)
 
 	return nil
 }
 
-func (dd *DockerDiscovery) start() error {
-	log.Println("[docker] start")
-	events := make(chan *dockerapi.APIEvents)
+// indexContainerInfo adds the container info to the container, domain and reverse maps.
+// The caller must hold the write lock.
+func (dd *DockerDiscovery) indexContainerInfo(containerInfo *ContainerInfo) {
+	dd.serial = uint32(time.Now().Unix())
+	dd.containerInfoMap[containerInfo.container.ID] = containerInfo
+	containersTracked.WithLabelValues(containerInfo.host.endpoint).Inc()
+	for resolver, count := range containerInfo.resolverNames {
+		namesTracked.WithLabelValues(resolver).Add(float64(count))
+	}
+	for _, d := range containerInfo.domains {
+		domain := canonicalDomain(d)
+		if dd.domainMap[domain] == nil {
+			dd.domainMap[domain] = make(ContainerInfoMap)
+			dd.addNonTerminals(domain)
+		}
+		dd.domainMap[domain][containerInfo.container.ID] = containerInfo
+	}
+	for _, address := range containerInfo.addresses() {
+		if dd.reverseMap[address.String()] == nil {
+			dd.reverseMap[address.String()] = make(ContainerInfoMap)
+		}
+		dd.reverseMap[address.String()][containerInfo.container.ID] = containerInfo
+	}
+}
 
-	if err := dd.dockerClient.AddEventListener(events); err != nil {
+// unindexContainerInfo removes the container info from the container, domain and reverse maps.
+// The caller must hold the write lock.
+func (dd *DockerDiscovery) unindexContainerInfo(containerID string) {
+	containerInfo, ok := dd.containerInfoMap[containerID]
+	if !ok {
+		return
+	}
+	dd.serial = uint32(time.Now().Unix())
+	containersTracked.WithLabelValues(containerInfo.host.endpoint).Dec()
+	for resolver, count := range containerInfo.resolverNames {
+		namesTracked.WithLabelValues(resolver).Sub(float64(count))
+	}
+	for _, d := range containerInfo.domains {
+		domain := canonicalDomain(d)
+		delete(dd.domainMap[domain], containerID)
+		if len(dd.domainMap[domain]) == 0 {
+			delete(dd.domainMap, domain)
+			dd.removeNonTerminals(domain)
+		}
+	}
+	for _, address := range containerInfo.addresses() {
+		delete(dd.reverseMap[address.String()], containerID)
+		if len(dd.reverseMap[address.String()]) == 0 {
+			delete(dd.reverseMap, address.String())
+		}
+	}
+	delete(dd.containerInfoMap, containerID)
+}
+
+func (dd *DockerDiscovery) hasContainerInfo(host *dockerHost, containerID string) bool {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	containerInfo, ok := dd.containerInfoMap[containerID]
+	return ok && containerInfo.host == host
+}
+
+// pruneContainerInfos removes the entries of the host's containers which are not running anymore
+func (dd *DockerDiscovery) pruneContainerInfos(host *dockerHost, running map[string]bool) {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	for containerID, containerInfo := range dd.containerInfoMap {
+		if containerInfo.host == host && !running[containerID] {
+			log.Printf("[docker] Deleting entry %s (%s) of vanished container", normalizeContainerName(containerInfo.container), containerID[:12])
+			dd.unindexContainerInfo(containerID)
+		}
+	}
+}
+
+// watch runs the event loop of the host, reconnecting with an exponential
+// backoff whenever the docker event stream can't be set up or drops
+func (dd *DockerDiscovery) watch(host *dockerHost) {
+	backoff := minReconnectBackoff
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			reconnects.WithLabelValues(host.endpoint).Inc()
+		}
+		connected := time.Now()
+		err := dd.start(host)
+		if time.Since(connected) > maxReconnectBackoff {
+			backoff = minReconnectBackoff
+		}
+		if dd.ctx.Err() != nil {
+			log.Printf("[docker] Event loop of %s stopped", host.endpoint)
+			return
+		}
+		log.Printf("[docker] Event loop of %s stopped: %s. Reconnecting in %s", host.endpoint, err, backoff)
+		select {
+		case <-dd.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// start listens to the docker events of the host after a full sync of its
+// containers, until the event stream closes or the plugin shuts down
+func (dd *DockerDiscovery) start(host *dockerHost) error {
+	log.Printf("[docker] start %s", host.endpoint)
+	// the docker client drops the events a listener isn't ready to receive
+	events := make(chan *dockerapi.APIEvents, 100)
+
+	if err := host.client.AddEventListener(events); err != nil {
 		return err
 	}
+	defer host.client.RemoveEventListener(events)
 
-	containers, err := dd.dockerClient.ListContainers(dockerapi.ListContainersOptions{})
+	if len(dd.hostNetwork) > 0 {
+		addresses := dd.resolveHostNetworkAddresses(host)
+		dd.mutex.Lock()
+		host.hostIPs = addresses
+		dd.mutex.Unlock()
+	}
+
+	// the event stream isn't filtered: label filters would drop the network events
+	containers, err := host.client.ListContainers(dockerapi.ListContainersOptions{
+		Filters: dd.filter.listFilters(),
+		Context: dd.ctx,
+	})
 	if err != nil {
 		return err
 	}
 
+	running := make(map[string]bool)
 	for _, apiContainer := range containers {
-		container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: apiContainer.ID})
+		running[apiContainer.ID] = true
+		if host.takenOver && dd.hasContainerInfo(host, apiContainer.ID) {
+			continue // known from the previous instance
+		}
+		container, err := host.client.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: apiContainer.ID, Context: dd.ctx})
 		if err != nil {
-			// TODO err
+			inspectErrors.WithLabelValues(host.endpoint).Inc()
+			log.Printf("[docker] Error inspecting container %s: %s", apiContainer.ID[:12], err)
+			continue
 		}
-		if err := dd.updateContainerInfo(container); err != nil {
+		if err := dd.updateContainerInfo(host, container); err != nil {
 			log.Printf("[docker] Error adding A/AAAA records for container %s: %s\n", container.ID[:12], err)
 		}
 	}
+	dd.pruneContainerInfos(host, running)
+	host.takenOver = false
 
-	for msg := range events {
-		go func(msg *dockerapi.APIEvents) {
-			event := fmt.Sprintf("%s:%s", msg.Type, msg.Action)
-			switch event {
-			case "container:start":
-				log.Println("[docker] New container spawned. Attempt to add A/AAAA records for it")
-
-				container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.ID})
-				if err != nil {
-					log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.ID[:12], err)
-					return
-				}
-				if err := dd.updateContainerInfo(container); err != nil {
-					log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
-				}
-			case "container:die":
-				log.Println("[docker] Container being stopped. Attempt to remove its A/AAAA records from the DNS", msg.Actor.ID[:12])
-				if err := dd.removeContainerInfo(msg.Actor.ID); err != nil {
-					log.Printf("[docker] Error deleting A/AAAA records for container: %s: %s", msg.Actor.ID[:12], err)
-				}
-			case "network:connect":
-				// take a look https://gist.github.com/josefkarasek/be9bac36921f7bc9a61df23451594fbf for example of same event's types attributes
-				log.Printf("[docker] Container %s being connected to network %s.", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
-
-				container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.Attributes["container"]})
-				if err != nil {
-					log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.Attributes["container"][:12], err)
-					return
-				}
-				if err := dd.updateContainerInfo(container); err != nil {
-					log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
-				}
-			case "network:disconnect":
-				log.Printf("[docker] Container %s being disconnected from network %s", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
-
-				container, err := dd.dockerClient.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.Attributes["container"]})
-				if err != nil {
-					log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.Attributes["container"][:12], err)
-					return
-				}
-				if err := dd.updateContainerInfo(container); err != nil {
-					log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
-				}
+	if err := dd.syncSwarm(host); err != nil {
+		log.Printf("[docker] Error loading swarm services: %s", err)
+	}
+
+	dd.setConnected(host, true)
+	defer dd.setConnected(host, false)
+
+	// the tasks of the other nodes start without an event on this one
+	var resync <-chan time.Time
+	if dd.swarmDomain != "" {
+		ticker := time.NewTicker(swarmResyncInterval)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for {
+		var msg *dockerapi.APIEvents
+		select {
+		case <-dd.ctx.Done():
+			return dd.ctx.Err()
+		case <-resync:
+			if err := dd.syncSwarm(host); err != nil {
+				log.Printf("[docker] Error loading swarm services: %s", err)
 			}
+			continue
+		case m, ok := <-events:
+			if !ok {
+				return errors.New("docker event loop closed")
+			}
+			msg = m
+		}
+
+		dd.wg.Add(1)
+		go func(msg *dockerapi.APIEvents) {
+			defer dd.wg.Done()
+			dd.handleEvent(host, msg)
 		}(msg)
 	}
+}
+
+// handleEvent updates the records of the host on a docker event
+func (dd *DockerDiscovery) handleEvent(host *dockerHost, msg *dockerapi.APIEvents) {
+	event := fmt.Sprintf("%s:%s", msg.Type, msg.Action)
+	eventsProcessed.WithLabelValues(host.endpoint, event).Inc()
+	if msg.Type == "service" || msg.Type == "node" {
+		log.Printf("[docker] Swarm %s. Attempt to reload swarm records", event)
+		if err := dd.syncSwarm(host); err != nil {
+			log.Printf("[docker] Error loading swarm services: %s", err)
+		}
+		return
+	}
+	// docker emits no task events: the tasks of a new or scaled service are
+	// still pending on its service event, they start with their containers
+	if isSwarmTaskEvent(msg) && dd.swarmDomain != "" {
+		log.Printf("[docker] Swarm task %s. Attempt to reload swarm records", event)
+		if err := dd.syncSwarm(host); err != nil {
+			log.Printf("[docker] Error loading swarm services: %s", err)
+		}
+	}
+	switch event {
+	case "container:start":
+		log.Println("[docker] New container spawned. Attempt to add A/AAAA records for it")
 
-	return errors.New("docker event loop closed")
+		container, err := host.client.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.ID, Context: dd.ctx})
+		if err != nil {
+			inspectErrors.WithLabelValues(host.endpoint).Inc()
+			log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.ID[:12], err)
+			return
+		}
+		if err := dd.updateContainerInfo(host, container); err != nil {
+			log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
+		}
+	case "container:die":
+		log.Println("[docker] Container being stopped. Attempt to remove its A/AAAA records from the DNS", msg.Actor.ID[:12])
+		if err := dd.removeContainerInfo(msg.Actor.ID); err != nil {
+			log.Printf("[docker] Error deleting A/AAAA records for container: %s: %s", msg.Actor.ID[:12], err)
+		}
+	case "network:connect":
+		// take a look https://gist.github.com/josefkarasek/be9bac36921f7bc9a61df23451594fbf for example of same event's types attributes
+		log.Printf("[docker] Container %s being connected to network %s.", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
+
+		container, err := host.client.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.Attributes["container"], Context: dd.ctx})
+		if err != nil {
+			inspectErrors.WithLabelValues(host.endpoint).Inc()
+			log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.Attributes["container"][:12], err)
+			return
+		}
+		if err := dd.updateContainerInfo(host, container); err != nil {
+			log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
+		}
+	case "network:disconnect":
+		log.Printf("[docker] Container %s being disconnected from network %s", msg.Actor.Attributes["container"][:12], msg.Actor.Attributes["name"])
+
+		container, err := host.client.InspectContainerWithOptions(dockerapi.InspectContainerOptions{ID: msg.Actor.Attributes["container"], Context: dd.ctx})
+		if err != nil {
+			inspectErrors.WithLabelValues(host.endpoint).Inc()
+			log.Printf("[docker] Event error %s #%s: %s", event, msg.Actor.Attributes["container"][:12], err)
+			return
+		}
+		if err := dd.updateContainerInfo(host, container); err != nil {
+			log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
+		}
+	}
 }
 
 // getAnswer function takes a slice of net.IPs and returns a slice of A/AAAA RRs.
@@ -344,3 +857,16 @@ func getAnswer(zone string, ips []net.IP, ttl uint32, v6 bool) []dns.RR {
 	}
 	return answers
 }
+
+// getPTRAnswer returns the PTR record pointing the reverse name to the target domain.
+func getPTRAnswer(zone string, target string, ttl uint32) []dns.RR {
+	record := new(dns.PTR)
+	record.Hdr = dns.RR_Header{
+		Name:   zone,
+		Rrtype: dns.TypePTR,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	record.Ptr = target
+	return []dns.RR{record}
+}
@@ -0,0 +1,952 @@
+package dockerdiscovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeSRV(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.Name = "web"
+	container.Config.ExposedPorts = map[dockerapi.Port]struct{}{
+		"80/tcp":  {},
+		"53/udp":  {},
+		"443/tcp": {},
+	}
+	container.Config.Labels["coredns.dockerdiscovery.srv.80.service"] = "http"
+	container.Config.Labels["coredns.dockerdiscovery.srv.80.weight"] = "5"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	resp := query(t, dd, "_http._tcp.web.docker.loc.", dns.TypeSRV)
+	assert.Len(t, resp.Answer, 1)
+	srv := resp.Answer[0].(*dns.SRV)
+	assert.Equal(t, uint16(80), srv.Port)
+	assert.Equal(t, uint16(5), srv.Weight)
+	assert.Equal(t, "web.docker.loc.", srv.Target)
+	assert.Len(t, resp.Extra, 1)
+	assert.Equal(t, "172.17.0.2", resp.Extra[0].(*dns.A).A.String())
+
+	resp = query(t, dd, "_53._udp.web.docker.loc.", dns.TypeSRV)
+	assert.Len(t, resp.Answer, 1)
+
+	resp = query(t, dd, "_53._tcp.web.docker.loc.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestServePTR(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	compose_domain compose.loc
+	ptr_domain compose.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.NetworkSettings.GlobalIPv6Address = "2001:db8::2"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	resp := query(t, dd, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "cservice.cproject.compose.loc.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	resp = query(t, dd, "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", dns.TypePTR)
+	assert.Len(t, resp.Answer, 1)
+
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	resp = query(t, dd, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Nil(t, resp)
+}
+
+func TestServeReplicas(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	compose_domain compose.loc
+	order round_robin
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	for i, address := range []string{"172.17.0.4", "172.17.0.2", "172.17.0.3"} {
+		container := genContainerDefn(address, "bridge", address)
+		container.ID = fmt.Sprintf("%d%s", i, container.ID[1:])
+		assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	}
+
+	first := query(t, dd, "cservice.cproject.compose.loc.", dns.TypeA)
+	assert.Len(t, first.Answer, 3)
+	second := query(t, dd, "cservice.cproject.compose.loc.", dns.TypeA)
+	assert.Len(t, second.Answer, 3)
+	assert.Equal(t, first.Answer[1].(*dns.A).A.String(), second.Answer[0].(*dns.A).A.String())
+}
+
+func TestDomainIndex(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	hostname_domain example.org.
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	_ = ipOk(t, dd, "Evil-Ptolemy.Docker.Loc.", net.ParseIP(container.NetworkSettings.IPAddress))
+	_ = ipOk(t, dd, "nginx.example.org.", net.ParseIP(container.NetworkSettings.IPAddress))
+
+	container.Config.Hostname = "apache"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "nginx.example.org.")
+	_ = ipOk(t, dd, "apache.example.org.", net.ParseIP(container.NetworkSettings.IPAddress))
+
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	ipNotOk(t, dd, "apache.example.org.")
+	assert.Empty(t, dd.domainMap)
+	assert.Empty(t, dd.nonTerminals)
+}
+
+func TestServePTRMultipleEndpoints(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	endpoint hostA unix:///var/run/docker.sock
+	endpoint hostB tcp://10.0.0.2:2375
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	// both hosts hand out the same bridge address
+	web := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	web.Config.Labels["coredns.dockerdiscovery.host"] = "web.loc"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], web))
+
+	db := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	db.ID = "b" + db.ID[1:]
+	db.Config.Labels = map[string]string{"coredns.dockerdiscovery.host": "db.loc"}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[1], db))
+
+	resp := query(t, dd, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Len(t, resp.Answer, 2)
+
+	assert.Nil(t, dd.removeContainerInfo(db.ID))
+	resp = query(t, dd, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "web.loc.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	assert.Nil(t, dd.removeContainerInfo(web.ID))
+	assert.Empty(t, dd.reverseMap)
+}
+
+func TestPruneContainerInfos(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	endpoint hostA unix:///var/run/docker.sock
+	endpoint hostB tcp://10.0.0.2:2375
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	gone := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	gone.Name = "gone"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], gone))
+
+	kept := genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")
+	kept.ID = "a" + kept.ID[1:]
+	kept.Name = "kept"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], kept))
+
+	other := genContainerDefn("172.17.0.4", "bridge", "172.17.0.4")
+	other.ID = "b" + other.ID[1:]
+	other.Name = "other"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[1], other))
+
+	dd.pruneContainerInfos(dd.hosts[0], map[string]bool{kept.ID: true})
+
+	ipNotOk(t, dd, "gone.docker.loc.")
+	_ = ipOk(t, dd, "kept.docker.loc.", net.ParseIP("172.17.0.3"))
+	_ = ipOk(t, dd, "other.docker.loc.", net.ParseIP("172.17.0.4"))
+}
+
+func TestMetrics(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///var/run/metrics.sock {
+	domain docker.loc
+	hostname_domain home.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	assert.Equal(t, 1.0, testutil.ToFloat64(containersTracked.WithLabelValues("unix:///var/run/metrics.sock")))
+
+	answered := testutil.ToFloat64(queries.WithLabelValues("", "A", "docker.loc.", resultAnswered))
+	negative := testutil.ToFloat64(queries.WithLabelValues("", "A", "docker.loc.", resultNegative))
+	_ = query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeA)
+	_ = query(t, dd, "missing.docker.loc.", dns.TypeA)
+	assert.Equal(t, answered+1, testutil.ToFloat64(queries.WithLabelValues("", "A", "docker.loc.", resultAnswered)))
+	assert.Equal(t, negative+1, testutil.ToFloat64(queries.WithLabelValues("", "A", "docker.loc.", resultNegative)))
+
+	assert.Nil(t, dd.removeContainerInfo(container.ID))
+	assert.Equal(t, 0.0, testutil.ToFloat64(containersTracked.WithLabelValues("unix:///var/run/metrics.sock")))
+}
+
+func TestReady(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	endpoint hostA unix:///var/run/docker.sock
+	endpoint hostB tcp://10.0.0.2:2375
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.False(t, dd.Ready())
+
+	dd.setConnected(dd.hosts[0], true)
+	assert.False(t, dd.Ready())
+
+	dd.setConnected(dd.hosts[1], true)
+	assert.True(t, dd.Ready())
+
+	dd.setConnected(dd.hosts[1], false)
+	assert.False(t, dd.Ready())
+	assert.True(t, dd.hosts[1].synced)
+}
+
+func TestReloadHandover(t *testing.T) {
+	endpoint := "unix:///var/run/reload.sock"
+	c := caddy.NewTestController("dns", `docker `+endpoint+` {
+	domain docker.loc
+}`)
+	old, err := createPlugin(c)
+	assert.Nil(t, err)
+	old.ownStreams()
+	old.setConnected(old.hosts[0], true)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	assert.Nil(t, old.updateContainerInfo(old.hosts[0], container))
+	assert.Nil(t, old.handOver())
+
+	c = caddy.NewTestController("dns", `docker `+endpoint+` {
+	hostname_domain home.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.run())
+	dd.setConnected(dd.hosts[0], true)
+
+	// the event loop takes the containers over
+	assert.Eventually(t, func() bool {
+		return dd.hasContainerInfo(dd.hosts[0], container.ID)
+	}, 5*time.Second, 10*time.Millisecond)
+	_ = ipOk(t, dd, "nginx.home.loc.", net.ParseIP("172.17.0.2"))
+	ipNotOk(t, dd, "evil-ptolemy.docker.loc.")
+
+	// the replaced instance withdraws its container and leaves the stream state to the new one
+	assert.Nil(t, clearHandover())
+	old.setConnected(old.hosts[0], false)
+	assert.Nil(t, old.stop())
+	assert.Equal(t, 1.0, testutil.ToFloat64(containersTracked.WithLabelValues(endpoint)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(eventStreamConnected.WithLabelValues(endpoint)))
+
+	stopped := make(chan error)
+	go func() { stopped <- dd.stop() }()
+	select {
+	case err := <-stopped:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event loop didn't stop")
+	}
+	assert.Equal(t, 0.0, testutil.ToFloat64(containersTracked.WithLabelValues(endpoint)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(eventStreamConnected.WithLabelValues(endpoint)))
+}
+
+func BenchmarkContainerInfosByDomain(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, count := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("containers=%d", count), func(b *testing.B) {
+			c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	hostname_domain home.loc
+	compose_domain compose.loc
+}`)
+			dd, err := createPlugin(c)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for i := 0; i < count; i++ {
+				container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+				container.ID = fmt.Sprintf("%012d%s", i, container.ID[12:])
+				container.Name = fmt.Sprintf("container-%d", i)
+				container.Config.Hostname = fmt.Sprintf("host-%d", i)
+				if err := dd.updateContainerInfo(dd.hosts[0], container); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			name := fmt.Sprintf("container-%d.docker.loc.", count/2)
+			b.Run("found", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if containerInfos, _ := dd.containerInfosByDomain(name); len(containerInfos) != 1 {
+						b.Fatalf("expected one container for %s, got %d", name, len(containerInfos))
+					}
+				}
+			})
+			b.Run("missing", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if containerInfos, _ := dd.containerInfosByDomain("missing.docker.loc."); len(containerInfos) != 0 {
+						b.Fatalf("expected no container for missing.docker.loc., got %d", len(containerInfos))
+					}
+					if dd.domainExists("missing.docker.loc.") {
+						b.Fatal("expected missing.docker.loc. not to exist")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestServeZone(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	compose_domain compose.loc
+	negative_ttl 10
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	resp := query(t, dd, "docker.loc.", dns.TypeSOA)
+	assert.Len(t, resp.Answer, 1)
+	assert.True(t, resp.Authoritative)
+
+	resp = query(t, dd, "compose.loc.", dns.TypeNS)
+	assert.Len(t, resp.Answer, 1)
+
+	resp = query(t, dd, "missing.docker.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	assert.Len(t, resp.Ns, 1)
+	assert.Equal(t, uint32(10), resp.Ns[0].(*dns.SOA).Minttl)
+
+	resp = query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	assert.Len(t, resp.Ns, 1)
+
+	// IPv4 only container
+	resp = query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	assert.Len(t, resp.Ns, 1)
+	assert.IsType(t, &dns.SOA{}, resp.Ns[0])
+
+	// empty non-terminal
+	resp = query(t, dd, "cproject.compose.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	resp = query(t, dd, "label-host.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	resp = query(t, dd, "label-host.loc.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	resp = query(t, dd, "example.org.", dns.TypeA)
+	assert.Nil(t, resp)
+}
+
+func TestServeFallthrough(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	compose_domain compose.loc
+	fallthrough compose.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	resp := query(t, dd, "missing.docker.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	resp = query(t, dd, "missing.compose.loc.", dns.TypeA)
+	assert.Nil(t, resp)
+
+	c = caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	fallthrough
+}`)
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+
+	resp = query(t, dd, "missing.docker.loc.", dns.TypeA)
+	assert.Nil(t, resp)
+}
+
+func TestRewriteDomains(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	compose_domain compose.loc
+	rewrite ^([a-z]+)_([a-z]+)\.docker\.loc$ $2.$1.docker.loc
+	rewrite \.compose\.loc$ .svc.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.Config.Labels["coredns.dockerdiscovery.host"] = "My_App.loc,-.loc"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	_ = ipOk(t, dd, "ptolemy.evil.docker.loc.", net.ParseIP("172.17.0.2"))
+	_ = ipOk(t, dd, "cservice.cproject.svc.loc.", net.ParseIP("172.17.0.2"))
+	ipNotOk(t, dd, "cservice.cproject.compose.loc.")
+
+	c = caddy.NewTestController("dns", `docker {
+	rewrite ([a-z
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+}
+
+func TestSanitizeDomain(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	for domain, expected := range map[string]string{
+		"Evil_Ptolemy.docker.loc": "evil-ptolemy.docker.loc",
+		"web.example.org.":        "web.example.org",
+		"_web_.loc":               "web.loc",
+		"my.app!.loc":             "my.app.loc",
+		"*.App.loc":               "*.app.loc",
+		long + ".loc":             strings.Repeat("a", 63) + ".loc",
+		strings.Repeat("a-", 40):  strings.Repeat("a-", 31) + "a",
+	} {
+		sanitized, err := sanitizeDomain(domain)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, sanitized)
+	}
+
+	for _, domain := range []string{"", "web..loc", "_.loc", "*", "web.*.loc", strings.Repeat(long+".", 4) + "loc"} {
+		_, err := sanitizeDomain(domain)
+		assert.NotNil(t, err, domain)
+	}
+}
+
+func TestContainerFilter(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	only_label coredns.enable=true
+	exclude_label coredns.skip
+	only_image nginx:* library/*
+	exclude_name ^tmp-
+	only_network bridge
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"label": {"coredns.enable=true"}}, dd.filter.listFilters())
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.Name = "web"
+	container.Config.Image = "nginx:latest"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "web.docker.loc.")
+
+	container.Config.Labels["coredns.enable"] = "true"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	_ = ipOk(t, dd, "web.docker.loc.", net.ParseIP("172.17.0.2"))
+
+	container.Config.Labels["coredns.skip"] = ""
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "web.docker.loc.")
+	delete(container.Config.Labels, "coredns.skip")
+
+	container.Config.Image = "redis:7"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "web.docker.loc.")
+	container.Config.Image = "library/nginx"
+
+	container.Name = "tmp-web"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "tmp-web.docker.loc.")
+	container.Name = "web"
+
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{"backend": {IPAddress: "172.18.0.2"}}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "web.docker.loc.")
+
+	c = caddy.NewTestController("dns", `docker {
+	only_image [nginx
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+
+	c = caddy.NewTestController("dns", `docker {
+	exclude_name (tmp
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+}
+
+func TestContainerTTL(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	compose_domain compose.loc
+	ttl 300
+	min_ttl 5
+	max_ttl 600
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	ci := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	ci.Name = "ci"
+	ci.Config.Labels[ttlLabel] = "1"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], ci))
+
+	db := genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")
+	db.ID = "a" + db.ID[1:]
+	db.Name = "db"
+	db.Config.Labels[ttlLabel] = "86400"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], db))
+
+	web := genContainerDefn("172.17.0.4", "bridge", "172.17.0.4")
+	web.ID = "b" + web.ID[1:]
+	web.Name = "web"
+	web.Config.Labels[ttlLabel] = "invalid"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], web))
+
+	resp := query(t, dd, "ci.docker.loc.", dns.TypeA)
+	assert.Equal(t, uint32(5), resp.Answer[0].Header().Ttl)
+	resp = query(t, dd, "db.docker.loc.", dns.TypeA)
+	assert.Equal(t, uint32(600), resp.Answer[0].Header().Ttl)
+	resp = query(t, dd, "web.docker.loc.", dns.TypeA)
+	assert.Equal(t, uint32(300), resp.Answer[0].Header().Ttl)
+	resp = query(t, dd, "3.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, uint32(600), resp.Answer[0].Header().Ttl)
+
+	// the RRset of replicas gets the lowest TTL
+	resp = query(t, dd, "cservice.cproject.compose.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 3)
+	for _, rr := range resp.Answer {
+		assert.Equal(t, uint32(5), rr.Header().Ttl)
+	}
+
+	c = caddy.NewTestController("dns", `docker {
+	min_ttl 60
+	max_ttl 30
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+}
+
+func TestLabelResolverNames(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	label app.host
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.Config.Labels["app.host"] = "web.loc, www.web.loc. api.loc"
+	container.Config.Labels["app.host.0"] = "admin.loc"
+	container.Config.Labels["app.host.10"] = "*.app.loc"
+	container.Config.Labels["app.host.2"] = "bad..loc,Static_Files.loc"
+	container.Config.Labels["app.host.x"] = "ignored.loc"
+
+	domains, _, _, err := dd.resolveDomainsByContainer(dd.hosts[0], container)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"web.loc", "www.web.loc", "api.loc", "admin.loc", "static-files.loc", "*.app.loc"}, domains)
+}
+
+func TestServeWildcard(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain app.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	app := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	app.Name = "app"
+	app.Config.Labels["coredns.dockerdiscovery.host"] = "*.app.loc"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], app))
+
+	admin := genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")
+	admin.ID = "a" + admin.ID[1:]
+	admin.Name = "admin"
+	admin.Config.Labels["coredns.dockerdiscovery.host"] = "api.internal.app.loc"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], admin))
+
+	resp := query(t, dd, "acme.app.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "acme.app.loc.", resp.Answer[0].Header().Name)
+	assert.Equal(t, "172.17.0.2", resp.Answer[0].(*dns.A).A.String())
+
+	resp = query(t, dd, "www.foo.app.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+
+	// exact names take precedence
+	resp = query(t, dd, "admin.app.loc.", dns.TypeA)
+	assert.Equal(t, "172.17.0.3", resp.Answer[0].(*dns.A).A.String())
+
+	// the existing internal.app.loc is the closest encloser
+	resp = query(t, dd, "internal.app.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+	resp = query(t, dd, "web.internal.app.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	resp = query(t, dd, "acme.app.loc.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	resp = query(t, dd, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, "app.app.loc.", resp.Answer[0].(*dns.PTR).Ptr)
+}
+
+func TestServeCNAME(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	network_aliases bridge
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.Config.Labels[cnameLabel] = "legacy-db.loc"
+	container.Config.ExposedPorts = map[dockerapi.Port]struct{}{"5432/tcp": {}}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	// the canonical name is the first resolved name, the PTR target
+	resp := query(t, dd, "legacy-db.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 2)
+	assert.Equal(t, "label-host.loc.", resp.Answer[0].(*dns.CNAME).Target)
+	assert.Equal(t, "label-host.loc.", resp.Answer[1].Header().Name)
+	assert.Equal(t, "172.17.0.2", resp.Answer[1].(*dns.A).A.String())
+
+	// CNAME without AAAA records
+	resp = query(t, dd, "legacy-db.loc.", dns.TypeAAAA)
+	assert.Len(t, resp.Answer, 1)
+
+	// the alias owns its CNAME record for any type
+	for _, qtype := range []uint16{dns.TypeCNAME, dns.TypeMX, dns.TypeSRV, dns.TypeTXT} {
+		resp = query(t, dd, "legacy-db.loc.", qtype)
+		assert.Len(t, resp.Answer, 1)
+		assert.Equal(t, "label-host.loc.", resp.Answer[0].(*dns.CNAME).Target)
+	}
+
+	// the SRV records below the alias target the canonical name
+	resp = query(t, dd, "_5432._tcp.legacy-db.loc.", dns.TypeSRV)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "label-host.loc.", resp.Answer[0].(*dns.SRV).Target)
+	assert.Len(t, resp.Extra, 1)
+	assert.Equal(t, "label-host.loc.", resp.Extra[0].Header().Name)
+
+	// label and network alias names are answered directly by default
+	resp = query(t, dd, "label-host.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, dns.TypeA, resp.Answer[0].Header().Rrtype)
+
+	c = caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	network_aliases bridge
+	cname_aliases
+	txt
+}`)
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	for _, name := range []string{"label-host.loc.", "myproject.loc."} {
+		resp = query(t, dd, name, dns.TypeA)
+		assert.Len(t, resp.Answer, 2)
+		assert.Equal(t, "evil-ptolemy.docker.loc.", resp.Answer[0].(*dns.CNAME).Target)
+	}
+
+	// TXT records of the canonical name follow the CNAME
+	resp = query(t, dd, "label-host.loc.", dns.TypeTXT)
+	assert.Len(t, resp.Answer, 2)
+	assert.Equal(t, "evil-ptolemy.docker.loc.", resp.Answer[1].Header().Name)
+
+	resp = query(t, dd, "2.0.17.172.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, "evil-ptolemy.docker.loc.", resp.Answer[0].(*dns.PTR).Ptr)
+}
+
+func TestServeTXT(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	container.Config.Image = "nginx:latest"
+	container.Config.Labels["coredns.dockerdiscovery.txt.owner"] = "team-a"
+	container.Config.Labels["app.secret"] = "hunter2"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	// disabled by default
+	resp := query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeTXT)
+	assert.Empty(t, resp.Answer)
+
+	c = caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	txt
+}`)
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	resp = query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeTXT)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, []string{
+		"id=fa155d6fd141",
+		"image=nginx:latest",
+		"compose_project=cproject",
+		"compose_service=cservice",
+		"network=bridge",
+		"coredns.dockerdiscovery.txt.owner=team-a",
+	}, resp.Answer[0].(*dns.TXT).Txt)
+
+	c = caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	txt app.
+}`)
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	resp = query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeTXT)
+	assert.Contains(t, resp.Answer[0].(*dns.TXT).Txt, "app.secret=hunter2")
+	assert.NotContains(t, resp.Answer[0].(*dns.TXT).Txt, "coredns.dockerdiscovery.txt.owner=team-a")
+}
+
+func TestHostNetworkAddress(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///var/run/nonexistent.sock {
+	domain docker.loc
+	host_network_address 10.0.0.5 fd00::5 nonexistent0
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "host", "")
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{"host": {}}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	ipNotOk(t, dd, "evil-ptolemy.docker.loc.")
+
+	// the unknown interface is skipped
+	dd.hosts[0].hostIPs = dd.resolveHostNetworkAddresses(dd.hosts[0])
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.5"), net.ParseIP("fd00::5")}, dd.hosts[0].hostIPs)
+
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	_ = ipOk(t, dd, "evil-ptolemy.docker.loc.", net.ParseIP("10.0.0.5"))
+
+	resp := query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeAAAA)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, "fd00::5", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// the address of the docker host is shared by all the host network
+	// containers, it gets no PTR record
+	resp = query(t, dd, "5.0.0.10.in-addr.arpa.", dns.TypePTR)
+	assert.Nil(t, resp)
+
+	// auto is skipped while the daemon is unreachable
+	dd.hostNetwork = []string{hostNetworkAuto}
+	assert.Empty(t, dd.resolveHostNetworkAddresses(dd.hosts[0]))
+
+	// the address behind a socket isn't guessed outside of a swarm
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "docker.sock"))
+	assert.Nil(t, err)
+	daemon := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	}))
+	daemon.Listener = listener
+	daemon.Start()
+	defer daemon.Close()
+	dd.hosts[0].client, err = dockerapi.NewClient("unix://" + listener.Addr().String())
+	assert.Nil(t, err)
+	_, err = dd.dockerHostAddresses(dd.hosts[0])
+	assert.ErrorContains(t, err, "set an address or an interface")
+}
+
+func TestServePublished(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	hostname_domain lan.loc
+	host_network_address 192.168.1.10
+	published lan.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	dd.hosts[0].hostIPs = dd.resolveHostNetworkAddresses(dd.hosts[0])
+
+	web := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	web.Name = "web"
+	web.Config.Hostname = "web"
+	web.NetworkSettings.Ports = map[dockerapi.Port][]dockerapi.PortBinding{
+		"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "8080"}},
+		"443/tcp": {},
+	}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], web))
+
+	db := genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")
+	db.ID = "a" + db.ID[1:]
+	db.Name = "db"
+	db.Config.Hostname = "db"
+	db.Config.Labels[publishedLabel] = "true"
+	db.NetworkSettings.Ports = map[dockerapi.Port][]dockerapi.PortBinding{
+		"5432/tcp": {{HostIP: "127.0.0.1", HostPort: "15432"}},
+	}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], db))
+
+	resp := query(t, dd, "web.lan.loc.", dns.TypeA)
+	assert.Equal(t, "192.168.1.10", resp.Answer[0].(*dns.A).A.String())
+	resp = query(t, dd, "web.docker.loc.", dns.TypeA)
+	assert.Equal(t, "172.17.0.2", resp.Answer[0].(*dns.A).A.String())
+
+	resp = query(t, dd, "_80._tcp.web.lan.loc.", dns.TypeSRV)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, uint16(8080), resp.Answer[0].(*dns.SRV).Port)
+	assert.Equal(t, "192.168.1.10", resp.Extra[0].(*dns.A).A.String())
+	resp = query(t, dd, "_443._tcp.web.lan.loc.", dns.TypeSRV)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	resp = query(t, dd, "_80._tcp.web.docker.loc.", dns.TypeSRV)
+	assert.Equal(t, uint16(80), resp.Answer[0].(*dns.SRV).Port)
+
+	// the label publishes all the names of the container
+	resp = query(t, dd, "db.docker.loc.", dns.TypeA)
+	assert.Equal(t, "127.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	resp = query(t, dd, "_5432._tcp.db.docker.loc.", dns.TypeSRV)
+	assert.Equal(t, uint16(15432), resp.Answer[0].(*dns.SRV).Port)
+
+	// -p 8080:80 has no routable address without host_network_address
+	c = caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	published
+}`)
+	_, err = createPlugin(c)
+	assert.ErrorContains(t, err, "published requires host_network_address")
+}
+
+func TestServeClientSubnet(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	domain docker.loc
+	client_subnet frontend
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "backend", "")
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{
+		"backend":  {IPAddress: "10.240.0.5", IPPrefixLen: 24},
+		"frontend": {IPAddress: "172.20.0.5", IPPrefixLen: 16, GlobalIPv6Address: "fd00::5", GlobalIPv6PrefixLen: 64},
+	}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	// the test client is 10.240.0.1
+	resp := query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeA)
+	assert.Equal(t, "10.240.0.5", resp.Answer[0].(*dns.A).A.String())
+
+	for subnet, expected := range map[string]string{
+		"172.20.3.0": "172.20.0.5",
+		"10.240.0.0": "10.240.0.5",
+		"192.0.2.0":  "172.20.0.5",
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion("evil-ptolemy.docker.loc.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet),
+		})
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := dd.ServeDNS(context.Background(), rec, m)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, rec.Msg.Answer[0].(*dns.A).A.String(), subnet)
+
+		// the reply scopes the answer to the source prefix of the client
+		reply := rec.Msg.IsEdns0()
+		assert.NotNil(t, reply)
+		assert.Len(t, reply.Option, 1)
+		scope := reply.Option[0].(*dns.EDNS0_SUBNET)
+		assert.Equal(t, uint8(24), scope.SourceScope)
+		assert.Equal(t, net.ParseIP(subnet).To4(), scope.Address.To4())
+	}
+
+	// no option without an EDNS client subnet in the request
+	assert.Nil(t, resp.IsEdns0())
+
+	resp = query(t, dd, "5.0.20.172.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, "label-host.loc.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	resp = query(t, dd, "evil-ptolemy.docker.loc.", dns.TypeAAAA)
+	assert.Equal(t, "fd00::5", resp.Answer[0].(*dns.AAAA).AAAA.String())
+}
+
+func TestNetworkPreference(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///var/run/nonexistent.sock {
+	domain docker.loc
+	network_preference frontend proxy
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	container := genContainerDefn("", "cproject_default", "172.18.0.2")
+	container.NetworkSettings.Networks["proxy"] = dockerapi.ContainerNetwork{IPAddress: "172.19.0.2"}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	_ = ipOk(t, dd, "evil-ptolemy.docker.loc.", net.ParseIP("172.19.0.2"))
+
+	// the network mode without a preferred network
+	delete(container.NetworkSettings.Networks, "proxy")
+	container.NetworkSettings.Networks["backend"] = dockerapi.ContainerNetwork{IPAddress: "172.20.0.2"}
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+	_ = ipOk(t, dd, "evil-ptolemy.docker.loc.", net.ParseIP("172.18.0.2"))
+
+	// the first non-internal network in name order otherwise
+	dd.hosts[0].internalNets = map[string]bool{"backend-id": true}
+	container.NetworkSettings.Networks["backend"] = dockerapi.ContainerNetwork{IPAddress: "172.20.0.2", NetworkID: "backend-id"}
+	container.NetworkSettings.Networks["db"] = dockerapi.ContainerNetwork{IPAddress: "172.21.0.2"}
+	_, network, ok := dd.preferredNetwork(dd.hosts[0], container, "host")
+	assert.True(t, ok)
+	assert.Equal(t, "172.18.0.2", network.IPAddress)
+	delete(container.NetworkSettings.Networks, "cproject_default")
+	_, network, _ = dd.preferredNetwork(dd.hosts[0], container, "host")
+	assert.Equal(t, "172.21.0.2", network.IPAddress)
+
+	// a network the unreachable daemon can't inspect isn't cached
+	container.NetworkSettings.Networks["db"] = dockerapi.ContainerNetwork{IPAddress: "172.21.0.2", NetworkID: "db-id"}
+	dd.inspectNetworks(dd.hosts[0], container)
+	assert.Equal(t, map[string]bool{"backend-id": true}, dd.hosts[0].internalNets)
+}
+
+// query sends a question to the plugin and returns the written response,
+// nil when the query was passed on to the next plugin
+func query(t *testing.T, dd *DockerDiscovery, name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+
+	_, err := dd.ServeDNS(context.Background(), rec, m)
+	if err != nil {
+		return nil
+	}
+	return rec.Msg
+}
@@ -0,0 +1,132 @@
+package dockerdiscovery
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// labelSelector matches the containers having the label, with the value when set
+type labelSelector struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// parseLabelSelector parses a KEY or KEY=VALUE selector, the docker filter syntax
+func parseLabelSelector(selector string) labelSelector {
+	key, value, hasValue := strings.Cut(selector, "=")
+	return labelSelector{key: key, value: value, hasValue: hasValue}
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	value, ok := labels[s.key]
+	return ok && (!s.hasValue || value == s.value)
+}
+
+func (s labelSelector) String() string {
+	if s.hasValue {
+		return s.key + "=" + s.value
+	}
+	return s.key
+}
+
+// containerFilter selects the containers which get DNS records. A container
+// must match all the only_label selectors and one pattern of each other
+// only_* list, and none of the exclude_* ones.
+type containerFilter struct {
+	onlyLabels      []labelSelector
+	excludeLabels   []labelSelector
+	onlyImages      []string // path.Match patterns
+	excludeImages   []string
+	onlyNames       []*regexp.Regexp
+	excludeNames    []*regexp.Regexp
+	onlyNetworks    []string
+	excludeNetworks []string
+}
+
+// matches reports whether the container passes the filter
+func (f *containerFilter) matches(container *dockerapi.Container) bool {
+	var labels map[string]string
+	var image string
+	if container.Config != nil {
+		labels = container.Config.Labels
+		image = container.Config.Image
+	}
+	for _, selector := range f.onlyLabels {
+		if !selector.matches(labels) {
+			return false
+		}
+	}
+	for _, selector := range f.excludeLabels {
+		if selector.matches(labels) {
+			return false
+		}
+	}
+
+	if len(f.onlyImages) > 0 && !matchesImage(f.onlyImages, image) {
+		return false
+	}
+	if matchesImage(f.excludeImages, image) {
+		return false
+	}
+
+	name := normalizeContainerName(container)
+	if len(f.onlyNames) > 0 && !matchesName(f.onlyNames, name) {
+		return false
+	}
+	if matchesName(f.excludeNames, name) {
+		return false
+	}
+
+	var networks map[string]dockerapi.ContainerNetwork
+	if container.NetworkSettings != nil {
+		networks = container.NetworkSettings.Networks
+	}
+	if len(f.onlyNetworks) > 0 && !matchesNetwork(f.onlyNetworks, networks) {
+		return false
+	}
+	return !matchesNetwork(f.excludeNetworks, networks)
+}
+
+// listFilters returns the only_label selectors as docker filters, so that
+// the daemon doesn't list the containers which wouldn't pass the filter
+func (f *containerFilter) listFilters() map[string][]string {
+	if len(f.onlyLabels) == 0 {
+		return nil
+	}
+	var labels []string
+	for _, selector := range f.onlyLabels {
+		labels = append(labels, selector.String())
+	}
+	return map[string][]string{"label": labels}
+}
+
+func matchesImage(patterns []string, image string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, image); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesName(patterns []*regexp.Regexp, name string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesNetwork(names []string, networks map[string]dockerapi.ContainerNetwork) bool {
+	for _, name := range names {
+		if _, ok := networks[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+)
+
+const hostNetworkAuto = "auto"
+
+// resolveHostNetworkAddresses returns the addresses answered for the host
+// network containers of the host. Each hostNetworkAddress value is an IP, the
+// name of a local interface or auto for the address of the docker host: its
+// swarm node address, or the host of a tcp endpoint.
+func (dd *DockerDiscovery) resolveHostNetworkAddresses(host *dockerHost) []net.IP {
+	var addresses []net.IP
+	for _, value := range dd.hostNetwork {
+		var resolved []net.IP
+		var err error
+		if address := net.ParseIP(value); address != nil {
+			resolved = []net.IP{address}
+		} else if value == hostNetworkAuto {
+			resolved, err = dd.dockerHostAddresses(host)
+		} else {
+			resolved, err = interfaceAddresses(value)
+		}
+		if err != nil {
+			log.Printf("[docker] Error resolving the host network address %s of %s: %s", value, host.endpoint, err)
+			continue
+		}
+		addresses = append(addresses, resolved...)
+	}
+	return addresses
+}
+
+// dockerHostAddresses returns the address of the docker host
+func (dd *DockerDiscovery) dockerHostAddresses(host *dockerHost) ([]net.IP, error) {
+	info, err := host.client.Info()
+	if err != nil {
+		return nil, err
+	}
+	if address := net.ParseIP(info.Swarm.NodeAddr); address != nil {
+		return []net.IP{address}, nil
+	}
+
+	endpoint, err := url.Parse(host.client.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	// the local address of a socket endpoint is the one of CoreDNS, which
+	// may run in a bridge container with the socket mounted
+	if endpoint.Scheme != "tcp" && endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("can't detect the address of a %s endpoint outside of a swarm, set an address or an interface", endpoint.Scheme)
+	}
+	if address := net.ParseIP(endpoint.Hostname()); address != nil {
+		return []net.IP{address}, nil
+	}
+	return net.LookupIP(endpoint.Hostname())
+}
+
+// interfaceAddresses returns the addresses of the local network interface
+func interfaceAddresses(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var addresses []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			addresses = append(addresses, ipNet.IP)
+		}
+	}
+	return addresses, nil
+}
+
+// hostNetworkAddress returns the first IPv4 or IPv6 host network address of the host
+func hostNetworkAddress(host *dockerHost, v6 bool) net.IP {
+	for _, address := range host.hostIPs {
+		if (address.To4() == nil) == v6 {
+			return address
+		}
+	}
+	return nil
+}
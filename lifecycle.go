@@ -0,0 +1,101 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"sync"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// handover holds the containers of the instance being replaced by a reload,
+// by docker endpoint, so that the new instance doesn't inspect them again
+var handover = struct {
+	sync.Mutex
+	containers map[string][]*dockerapi.Container
+}{}
+
+// run starts the event loop of every endpoint. The handed over containers are
+// taken over by the event loops, as resolving them may query a slow daemon.
+func (dd *DockerDiscovery) run() error {
+	dd.ownStreams()
+	for _, host := range dd.hosts {
+		handover.Lock()
+		containers := handover.containers[host.endpoint]
+		handover.Unlock()
+
+		dd.wg.Add(1)
+		go func(host *dockerHost) {
+			defer dd.wg.Done()
+			dd.takeOver(host, containers)
+			dd.watch(host)
+		}(host)
+	}
+	return nil
+}
+
+// stop cancels the event loops, waits for the in-flight event handlers,
+// withdraws the containers of the instance from the metrics and closes the
+// connections of the docker clients
+func (dd *DockerDiscovery) stop() error {
+	dd.cancel()
+	dd.wg.Wait()
+	dd.releaseStreams()
+
+	dd.mutex.Lock()
+	for containerID := range dd.containerInfoMap {
+		dd.unindexContainerInfo(containerID)
+	}
+	dd.mutex.Unlock()
+
+	for _, host := range dd.hosts {
+		if host.client.HTTPClient != nil {
+			host.client.HTTPClient.CloseIdleConnections()
+		}
+	}
+	log.Println("[docker] stopped")
+	return nil
+}
+
+// handOver saves the containers of every endpoint for the instance replacing this one
+func (dd *DockerDiscovery) handOver() error {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+	handover.Lock()
+	defer handover.Unlock()
+
+	if handover.containers == nil {
+		handover.containers = make(map[string][]*dockerapi.Container)
+	}
+	for _, containerInfo := range dd.containerInfoMap {
+		endpoint := containerInfo.host.endpoint
+		handover.containers[endpoint] = append(handover.containers[endpoint], containerInfo.container)
+	}
+	return nil
+}
+
+// takeOver resolves the containers handed over by the previous instance for the
+// endpoint with the current configuration, without listing them again
+func (dd *DockerDiscovery) takeOver(host *dockerHost, containers []*dockerapi.Container) {
+	if len(containers) == 0 {
+		return
+	}
+	log.Printf("[docker] Taking over %d containers of %s", len(containers), host.endpoint)
+	for _, container := range containers {
+		if dd.ctx.Err() != nil {
+			return
+		}
+		if err := dd.updateContainerInfo(host, container); err != nil {
+			log.Printf("[docker] Error adding A/AAAA records for container %s: %s", container.ID[:12], err)
+		}
+	}
+	host.takenOver = true
+}
+
+// clearHandover drops the handed over containers once the reload is over
+func clearHandover() error {
+	handover.Lock()
+	defer handover.Unlock()
+
+	handover.containers = nil
+	return nil
+}
@@ -0,0 +1,88 @@
+package dockerdiscovery
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// query results
+const (
+	resultAnswered    = "answered"
+	resultNegative    = "negative"
+	resultFallthrough = "fallthrough"
+)
+
+var (
+	// containersTracked is the number of containers with DNS records by endpoint.
+	containersTracked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "containers",
+		Help:      "The number of containers with DNS records.",
+	}, []string{"endpoint"})
+	// namesTracked is the number of container names by resolver type.
+	namesTracked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "names",
+		Help:      "The number of container names by resolver type.",
+	}, []string{"resolver"})
+	// eventsProcessed is the counter of docker events by Type:Action.
+	eventsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "events_total",
+		Help:      "The count of processed docker events.",
+	}, []string{"endpoint", "event"})
+	// inspectErrors is the counter of failed container inspections.
+	inspectErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "inspect_errors_total",
+		Help:      "The count of failed container inspections.",
+	}, []string{"endpoint"})
+	// reconnects is the counter of event loop restarts.
+	reconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "reconnects_total",
+		Help:      "The count of docker event loop reconnections.",
+	}, []string{"endpoint"})
+	// eventStreamConnected is 1 while the docker event stream of the endpoint is connected.
+	eventStreamConnected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "event_stream_connected",
+		Help:      "Whether the docker event stream is connected.",
+	}, []string{"endpoint"})
+	// queries is the counter of queries by qtype, zone and result.
+	queries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "docker",
+		Name:      "queries_total",
+		Help:      "The count of queries answered, answered negatively or fallen through.",
+	}, []string{"server", "qtype", "zone", "result"})
+)
+
+// resolverType returns the Corefile directive of the resolver, used as metric label
+func resolverType(resolver ContainerDomainResolver) string {
+	switch resolver.(type) {
+	case *SubDomainContainerNameResolver:
+		return "domain"
+	case *SubDomainHostResolver:
+		return "hostname_domain"
+	case *ComposeResolver:
+		return "compose_domain"
+	case *NetworkAliasesResolver:
+		return "network_aliases"
+	case *LabelResolver:
+		return "label"
+	case *CNAMEResolver:
+		return "cname"
+	case *TemplateResolver:
+		return "template"
+	}
+	return "other"
+}
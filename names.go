@@ -0,0 +1,66 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxLabelLength  = 63
+	maxDomainLength = 253
+)
+
+// rewriteRule rewrites the resolved domains matching the pattern, the
+// replacement may refer to the submatches as $1, $2...
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]`)
+
+// splitNames splits a list of names separated by commas or white spaces
+func splitNames(names string) []string {
+	return strings.FieldsFunc(names, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// rewriteDomain applies the rewrite rules in order
+func rewriteDomain(domain string, rules []rewriteRule) string {
+	for _, rule := range rules {
+		domain = rule.pattern.ReplaceAllString(domain, rule.replacement)
+	}
+	return domain
+}
+
+// sanitizeDomain turns the domain into RFC 1123 labels: letters are lowered,
+// underscores and other invalid characters become hyphens, leading and
+// trailing hyphens are trimmed and labels are truncated to 63 characters.
+// A leftmost * label is kept for wildcard domains. It returns an error when
+// the domain can't be fixed.
+func sanitizeDomain(domain string) (string, error) {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i, label := range labels {
+		if i == 0 && label == "*" && len(labels) > 1 {
+			continue
+		}
+		label = invalidLabelChars.ReplaceAllString(strings.ToLower(label), "-")
+		if len(label) > maxLabelLength {
+			label = label[:maxLabelLength]
+		}
+		label = strings.Trim(label, "-")
+		if label == "" {
+			return "", fmt.Errorf("empty label in domain %q", domain)
+		}
+		labels[i] = label
+	}
+
+	sanitized := strings.Join(labels, ".")
+	if len(sanitized) > maxDomainLength {
+		return "", fmt.Errorf("domain %q is longer than %d characters", domain, maxDomainLength)
+	}
+	return sanitized, nil
+}
@@ -0,0 +1,91 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"sort"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// preferredNetwork picks the network of a container connected to several
+// networks: the first of the network_preference networks it is connected to,
+// else the network of its network mode, else the first non-internal network in
+// name order. The caller must hold the lock.
+func (dd *DockerDiscovery) preferredNetwork(host *dockerHost, container *dockerapi.Container, networkMode string) (string, dockerapi.ContainerNetwork, bool) {
+	networks := container.NetworkSettings.Networks
+	for _, name := range dd.networkOrder {
+		if network, ok := networks[name]; ok {
+			return name, network, true
+		}
+	}
+
+	if networkMode == "default" {
+		networkMode = "bridge"
+	}
+	if network, ok := networks[networkMode]; ok {
+		return networkMode, network, true
+	}
+
+	var names []string
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !dd.isInternalNetwork(host, networks[name].NetworkID) {
+			return name, networks[name], true
+		}
+	}
+	if len(names) > 0 {
+		return names[0], networks[names[0]], true
+	}
+	return "", dockerapi.ContainerNetwork{}, false
+}
+
+// isInternalNetwork reports whether the network was created with --internal,
+// as looked up by inspectNetworks. The caller must hold the lock.
+func (dd *DockerDiscovery) isInternalNetwork(host *dockerHost, networkID string) bool {
+	return host.internalNets[networkID]
+}
+
+// inspectNetworks looks up once the networks of a container connected to
+// several networks, before updateContainerInfo takes the lock. NetworkInfo has
+// no context, the lookups stop with the instance instead.
+func (dd *DockerDiscovery) inspectNetworks(host *dockerHost, container *dockerapi.Container) {
+	if container.NetworkSettings == nil || len(container.NetworkSettings.Networks) < 2 {
+		return
+	}
+	var networkIDs []string
+	dd.mutex.RLock()
+	for _, network := range container.NetworkSettings.Networks {
+		if _, ok := host.internalNets[network.NetworkID]; !ok && network.NetworkID != "" {
+			networkIDs = append(networkIDs, network.NetworkID)
+		}
+	}
+	dd.mutex.RUnlock()
+
+	internal := make(map[string]bool)
+	for _, networkID := range networkIDs {
+		if dd.ctx.Err() != nil {
+			return
+		}
+		network, err := host.client.NetworkInfo(networkID)
+		if err != nil {
+			log.Printf("[docker] Error inspecting network %s: %s", networkID, err)
+			continue
+		}
+		internal[networkID] = network.Internal
+	}
+	if len(internal) == 0 {
+		return
+	}
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	if host.internalNets == nil {
+		host.internalNets = make(map[string]bool)
+	}
+	for networkID, isInternal := range internal {
+		host.internalNets[networkID] = isInternal
+	}
+}
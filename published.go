@@ -0,0 +1,90 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/coredns/coredns/plugin"
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+const publishedLabel = "coredns.dockerdiscovery.published"
+
+// isPublished reports whether the name of the container is answered with its
+// published address: when the name is in a published zone or the container
+// has the published label
+func (dd *DockerDiscovery) isPublished(name string, containerInfo *ContainerInfo) bool {
+	if published, err := strconv.ParseBool(containerInfo.container.Config.Labels[publishedLabel]); err == nil {
+		return published
+	}
+	return plugin.Zones(dd.publishZones).Matches(canonicalDomain(name)) != ""
+}
+
+// publishedAddress returns the host address the container publishes its ports
+// on: the host IP of the first port binding, or the host network address of
+// the docker host when the port is bound to all the interfaces. It returns nil
+// when the container doesn't publish ports. The caller must hold the lock.
+func publishedAddress(host *dockerHost, container *dockerapi.Container, v6 bool) net.IP {
+	if container.NetworkSettings == nil {
+		return nil
+	}
+	var ports []string
+	for port := range container.NetworkSettings.Ports {
+		ports = append(ports, string(port))
+	}
+	sort.Strings(ports)
+
+	for _, port := range ports {
+		for _, binding := range container.NetworkSettings.Ports[dockerapi.Port(port)] {
+			address := net.ParseIP(binding.HostIP)
+			if address == nil || address.IsUnspecified() {
+				if address != nil && (address.To4() == nil) != v6 {
+					continue
+				}
+				if address := hostNetworkAddress(host, v6); address != nil {
+					return address
+				}
+				continue
+			}
+			if (address.To4() == nil) == v6 {
+				return address
+			}
+		}
+	}
+	return nil
+}
+
+// publishesOnAllInterfaces reports whether a port of the container is bound
+// to all the interfaces of the docker host, e.g. by -p 8080:80
+func publishesOnAllInterfaces(container *dockerapi.Container) bool {
+	if container.NetworkSettings == nil {
+		return false
+	}
+	for _, bindings := range container.NetworkSettings.Ports {
+		for _, binding := range bindings {
+			if address := net.ParseIP(binding.HostIP); binding.HostIP == "" || (address != nil && address.IsUnspecified()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publishedSRVPorts returns the ports with their published host port, the
+// ports which aren't published are dropped
+func publishedSRVPorts(container *dockerapi.Container, ports []srvPort) []srvPort {
+	var published []srvPort
+	for _, port := range ports {
+		for _, binding := range container.NetworkSettings.Ports[port.containerPort] {
+			hostPort, err := strconv.ParseUint(binding.HostPort, 10, 16)
+			if err != nil {
+				continue
+			}
+			port.port = uint16(hostPort)
+			published = append(published, port)
+			break
+		}
+	}
+	return published
+}
@@ -0,0 +1,73 @@
+package dockerdiscovery
+
+import "sync"
+
+// streamOwners holds the instance owning the event stream gauge of each
+// endpoint: the last one started, so that an instance being replaced by a
+// reload doesn't overwrite the state reported by its successor
+var streamOwners = struct {
+	sync.Mutex
+	instances map[string]*DockerDiscovery
+}{instances: make(map[string]*DockerDiscovery)}
+
+// Ready implements the ready.Readiness interface. The plugin is ready once the
+// containers of every endpoint are loaded and their event streams are connected.
+func (dd *DockerDiscovery) Ready() bool {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	for _, host := range dd.hosts {
+		if !host.synced || !host.connected {
+			return false
+		}
+	}
+	return true
+}
+
+// setConnected records whether the event stream of the host is connected.
+// The initial sync of the host is complete the first time it connects.
+func (dd *DockerDiscovery) setConnected(host *dockerHost, connected bool) {
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+
+	host.connected = connected
+	if connected {
+		host.synced = true
+	}
+
+	streamOwners.Lock()
+	defer streamOwners.Unlock()
+	if streamOwners.instances[host.endpoint] != dd {
+		return
+	}
+	if connected {
+		eventStreamConnected.WithLabelValues(host.endpoint).Set(1)
+	} else {
+		eventStreamConnected.WithLabelValues(host.endpoint).Set(0)
+	}
+}
+
+// ownStreams makes the instance report the event stream state of its endpoints
+func (dd *DockerDiscovery) ownStreams() {
+	streamOwners.Lock()
+	defer streamOwners.Unlock()
+
+	for _, host := range dd.hosts {
+		streamOwners.instances[host.endpoint] = dd
+	}
+}
+
+// releaseStreams reports the event streams of the endpoints still owned by the
+// instance as disconnected, the endpoints taken over by another instance are
+// left to it
+func (dd *DockerDiscovery) releaseStreams() {
+	streamOwners.Lock()
+	defer streamOwners.Unlock()
+
+	for _, host := range dd.hosts {
+		if streamOwners.instances[host.endpoint] == dd {
+			delete(streamOwners.instances, host.endpoint)
+			eventStreamConnected.WithLabelValues(host.endpoint).Set(0)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package dockerdiscovery
 
 import (
+	"bytes"
 	"fmt"
 	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
 	"log"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 )
 
 func normalizeContainerName(container *dockerapi.Container) string {
@@ -33,6 +38,8 @@ func (resolver SubDomainHostResolver) resolve(container *dockerapi.Container) ([
 	return domains, nil
 }
 
+// LabelResolver sets names from the host label and its indexed variants
+// (<label>.0, <label>.1...), each holding names separated by spaces or commas
 type LabelResolver struct {
 	hostLabel string
 }
@@ -40,10 +47,33 @@ type LabelResolver struct {
 func (resolver LabelResolver) resolve(container *dockerapi.Container) ([]string, error) {
 	var domains []string
 
+	indexed := make(map[int]string)
+	var indexes []int
+	prefix := resolver.hostLabel + "."
 	for label, value := range container.Config.Labels {
-		if label == resolver.hostLabel {
-			domains = append(domains, value)
-			break
+		if !strings.HasPrefix(label, prefix) {
+			continue
+		}
+		if index, err := strconv.ParseUint(label[len(prefix):], 10, 16); err == nil {
+			indexed[int(index)] = value
+			indexes = append(indexes, int(index))
+		}
+	}
+	sort.Ints(indexes)
+
+	values := []string{container.Config.Labels[resolver.hostLabel]}
+	for _, index := range indexes {
+		values = append(values, indexed[index])
+	}
+
+	for _, value := range values {
+		for _, name := range splitNames(value) {
+			if _, ok := dns.IsDomainName(name); !ok || strings.HasPrefix(name, ".") {
+				log.Printf("[docker] Skipping invalid label domain %s for container %s", name, container.ID[:12])
+				continue
+			}
+			// label names are fully qualified
+			domains = append(domains, strings.TrimSuffix(name, "."))
 		}
 	}
 
@@ -91,3 +121,68 @@ func (resolver NetworkAliasesResolver) resolve(container *dockerapi.Container) (
 
 	return domains, nil
 }
+
+// TemplateResolver sets names from a text/template executed over the container,
+// e.g. {{.Labels "app"}}.{{.Compose.Project}}.svc.loc. The output may hold
+// several names separated by spaces or commas.
+type TemplateResolver struct {
+	template *template.Template
+}
+
+// templateContainer is the container as seen by the templates of TemplateResolver
+type templateContainer struct {
+	container *dockerapi.Container
+
+	ID       string // short container ID
+	Name     string
+	Hostname string
+	Image    string
+	Networks []string
+	Compose  struct {
+		Project string
+		Service string
+	}
+}
+
+// Labels returns the value of the container label, empty when unset
+func (c templateContainer) Labels(key string) string {
+	return c.container.Config.Labels[key]
+}
+
+func newTemplateContainer(container *dockerapi.Container) templateContainer {
+	c := templateContainer{
+		container: container,
+		ID:        container.ID[:12],
+		Name:      normalizeContainerName(container),
+		Hostname:  container.Config.Hostname,
+		Image:     container.Config.Image,
+	}
+	c.Compose.Project = container.Config.Labels["com.docker.compose.project"]
+	c.Compose.Service = container.Config.Labels["com.docker.compose.service"]
+	for network := range container.NetworkSettings.Networks {
+		c.Networks = append(c.Networks, network)
+	}
+	sort.Strings(c.Networks)
+	return c
+}
+
+func (resolver TemplateResolver) resolve(container *dockerapi.Container) ([]string, error) {
+	var domains []string
+
+	var output bytes.Buffer
+	if err := resolver.template.Execute(&output, newTemplateContainer(container)); err != nil {
+		return domains, err
+	}
+
+	for _, name := range splitNames(output.String()) {
+		name = strings.TrimSuffix(name, ".")
+		if strings.HasPrefix(name, ".") || strings.Contains(name, "..") {
+			// some template value was empty
+			log.Printf("[docker] Skipping incomplete template domain %s for container %s", name, container.ID[:12])
+			continue
+		}
+		domains = append(domains, name)
+	}
+
+	return domains, nil
+}
@@ -1,17 +1,22 @@
 package dockerdiscovery
 
 import (
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
+	"text/template"
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 
-	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
 
 	"github.com/coredns/caddy"
 )
 
 const defaultDockerEndpoint = "unix:///var/run/docker.sock"
+const envDockerEndpoint = "env"
 const defaultDockerDomain = "docker.local"
 
 func init() {
@@ -26,11 +31,15 @@ func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
 	dd := NewDockerDiscovery(defaultDockerEndpoint)
 	labelResolver := &LabelResolver{hostLabel: "coredns.dockerdiscovery.host"}
 	dd.resolvers = append(dd.resolvers, labelResolver)
+	dd.resolvers = append(dd.resolvers, &CNAMEResolver{LabelResolver{hostLabel: cnameLabel}})
+	defaultHost := dd.hosts[0]
+	var hasDefaultEndpoint bool
 
 	for c.Next() {
 		args := c.RemainingArgs()
 		if len(args) == 1 {
-			dd.dockerEndpoint = args[0]
+			defaultHost.endpoint = args[0]
+			hasDefaultEndpoint = true
 		}
 
 		if len(args) > 1 {
@@ -49,6 +58,7 @@ func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
 					return dd, c.ArgErr()
 				}
 				resolver.domain = c.Val()
+				dd.addZone(resolver.domain)
 			case "hostname_domain":
 				var resolver = &SubDomainHostResolver{
 					domain: defaultDockerDomain,
@@ -58,6 +68,7 @@ func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
 					return dd, c.ArgErr()
 				}
 				resolver.domain = c.Val()
+				dd.addZone(resolver.domain)
 			case "compose_domain":
 				var resolver = &ComposeResolver{
 					domain: defaultDockerDomain,
@@ -67,6 +78,88 @@ func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
 					return dd, c.ArgErr()
 				}
 				resolver.domain = c.Val()
+				dd.addZone(resolver.domain)
+			case "swarm_domain":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.swarmDomain = c.Val()
+				dd.addZone(dd.swarmDomain)
+			case "template":
+				// the lexer splits on spaces and strips quotes, a template
+				// with either must be quoted as a single argument
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return dd, c.Errf("template must be a single quoted argument, got %d arguments", len(args))
+				}
+				tmpl, err := template.New("template").Parse(args[0])
+				if err != nil {
+					return dd, c.Errf("invalid template: %s", err)
+				}
+				dd.resolvers = append(dd.resolvers, &TemplateResolver{template: tmpl})
+			case "rewrite":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return dd, c.ArgErr()
+				}
+				pattern, err := regexp.Compile(args[0])
+				if err != nil {
+					return dd, c.Errf("invalid rewrite pattern: %s", err)
+				}
+				dd.rewrites = append(dd.rewrites, rewriteRule{pattern: pattern, replacement: args[1]})
+			case "only_label", "exclude_label":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				for _, arg := range args {
+					if value == "only_label" {
+						dd.filter.onlyLabels = append(dd.filter.onlyLabels, parseLabelSelector(arg))
+					} else {
+						dd.filter.excludeLabels = append(dd.filter.excludeLabels, parseLabelSelector(arg))
+					}
+				}
+			case "only_image", "exclude_image":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				for _, arg := range args {
+					if _, err := path.Match(arg, ""); err != nil {
+						return dd, c.Errf("invalid image pattern '%s': %s", arg, err)
+					}
+				}
+				if value == "only_image" {
+					dd.filter.onlyImages = append(dd.filter.onlyImages, args...)
+				} else {
+					dd.filter.excludeImages = append(dd.filter.excludeImages, args...)
+				}
+			case "only_name", "exclude_name":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				for _, arg := range args {
+					pattern, err := regexp.Compile(arg)
+					if err != nil {
+						return dd, c.Errf("invalid name pattern: %s", err)
+					}
+					if value == "only_name" {
+						dd.filter.onlyNames = append(dd.filter.onlyNames, pattern)
+					} else {
+						dd.filter.excludeNames = append(dd.filter.excludeNames, pattern)
+					}
+				}
+			case "only_network", "exclude_network":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				if value == "only_network" {
+					dd.filter.onlyNetworks = append(dd.filter.onlyNetworks, args...)
+				} else {
+					dd.filter.excludeNetworks = append(dd.filter.excludeNetworks, args...)
+				}
 			case "network_aliases":
 				var resolver = &NetworkAliasesResolver{
 					network: "",
@@ -81,6 +174,110 @@ func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
 					return dd, c.ArgErr()
 				}
 				labelResolver.hostLabel = c.Val()
+			case "host_network_address":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				dd.hostNetwork = append(dd.hostNetwork, args...)
+			case "published":
+				zones := c.RemainingArgs()
+				if len(zones) == 0 {
+					zones = []string{"."}
+				}
+				for _, zone := range zones {
+					dd.publishZones = append(dd.publishZones, canonicalDomain(zone))
+				}
+			case "network_preference":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return dd, c.ArgErr()
+				}
+				dd.networkOrder = append(dd.networkOrder, args...)
+			case "client_subnet":
+				dd.clientSubnet = true
+				dd.subnetOrder = c.RemainingArgs()
+			case "ptr_domain":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				dd.ptrDomain = dns.Fqdn(strings.ToLower(c.Val()))
+			case "txt":
+				dd.txt = true
+				dd.txtLabelPrefixes = c.RemainingArgs()
+				if len(dd.txtLabelPrefixes) == 0 {
+					dd.txtLabelPrefixes = []string{defaultTXTLabelPrefix}
+				}
+			case "order":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				switch c.Val() {
+				case orderSorted, orderShuffle, orderRoundRobin:
+					dd.order = c.Val()
+				default:
+					return dd, c.Errf("unknown order: '%s'", c.Val())
+				}
+			case "min_ttl", "max_ttl":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return dd, err
+				}
+				if ttl > maxTTL {
+					return dd, c.Errf("%s larger than %d", value, maxTTL)
+				}
+				if value == "min_ttl" {
+					dd.minTTL = uint32(ttl)
+				} else {
+					dd.maxTTL = uint32(ttl)
+				}
+			case "negative_ttl":
+				if !c.NextArg() {
+					return dd, c.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return dd, err
+				}
+				dd.negativeTTL = uint32(ttl)
+			case "endpoint":
+				args := c.RemainingArgs()
+				if len(args) != 2 && len(args) != 5 {
+					return dd, c.ArgErr()
+				}
+				alias := strings.ToLower(args[0])
+				if _, ok := dns.IsDomainName(alias); !ok || dns.CountLabel(alias) != 1 {
+					return dd, c.Errf("invalid endpoint alias: '%s'", args[0])
+				}
+				for _, host := range dd.hosts {
+					if host.alias == alias {
+						return dd, c.Errf("duplicate endpoint alias: '%s'", args[0])
+					}
+				}
+				host := &dockerHost{alias: alias, endpoint: args[1]}
+				if len(args) == 5 {
+					host.tlsCert, host.tlsKey, host.tlsCA = args[2], args[3], args[4]
+				}
+				dd.hosts = append(dd.hosts, host)
+			case "tls":
+				args := c.RemainingArgs()
+				if len(args) != 3 {
+					return dd, c.ArgErr()
+				}
+				if !hasDefaultEndpoint {
+					// use the CERT KEY CA arguments of endpoint for the declared endpoints
+					return dd, c.Errf("tls requires a DOCKER_ENDPOINT argument")
+				}
+				defaultHost.tlsCert, defaultHost.tlsKey, defaultHost.tlsCA = args[0], args[1], args[2]
+			case "cname_aliases":
+				dd.cnameAliases = true
+			case "qualify_hosts":
+				dd.qualifyHosts = true
+			case "fallthrough":
+				dd.Fall.SetZonesFromArgs(c.RemainingArgs())
 			case "ttl":
 				if !c.NextArg() {
 					return dd, c.ArgErr()
@@ -97,12 +294,25 @@ func createPlugin(c *caddy.Controller) (*DockerDiscovery, error) {
 			}
 		}
 	}
-	dockerClient, err := dockerapi.NewClient(dd.dockerEndpoint)
-	if err != nil {
-		return dd, err
+	if dd.minTTL > dd.maxTTL {
+		return dd, c.Errf("min_ttl %d larger than max_ttl %d", dd.minTTL, dd.maxTTL)
+	}
+	if len(dd.publishZones) > 0 && len(dd.hostNetwork) == 0 {
+		// ports bound to all interfaces would be answered with the bridge address
+		return dd, c.Errf("published requires host_network_address")
+	}
+	if len(dd.hosts) > 1 && !hasDefaultEndpoint {
+		// only the declared endpoints are watched
+		dd.hosts = dd.hosts[1:]
+	}
+
+	for _, host := range dd.hosts {
+		dockerClient, err := host.newClient()
+		if err != nil {
+			return dd, err
+		}
+		host.client = dockerClient
 	}
-	dd.dockerClient = dockerClient
-	go dd.start()
 	return dd, nil
 }
 
@@ -112,6 +322,15 @@ func setup(c *caddy.Controller) error {
 		return err
 	}
 
+	c.OnStartup(dd.run)
+	c.OnRestart(dd.handOver)
+	c.OnRestartFailed(clearHandover)
+	c.OnShutdown(func() error {
+		// the replacing instance has taken over on reload
+		clearHandover()
+		return dd.stop()
+	})
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		dd.Next = next
 		return dd
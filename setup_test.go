@@ -3,6 +3,7 @@ package dockerdiscovery
 import (
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 
 	"github.com/coredns/caddy"
@@ -48,7 +49,7 @@ func TestConfigDockerDiscovery(t *testing.T) {
 		c := caddy.NewTestController("dns", tc.configBlock)
 		dd, err := createPlugin(c)
 		assert.Nil(t, err)
-		assert.Equal(t, dd.dockerEndpoint, tc.expectedDockerEndpoint)
+		assert.Equal(t, dd.hosts[0].endpoint, tc.expectedDockerEndpoint)
 	}
 }
 
@@ -72,7 +73,7 @@ func TestSetupDockerDiscovery(t *testing.T) {
 
 	for i := range containers {
 		container := containers[i]
-		e := dd.updateContainerInfo(container)
+		e := dd.updateContainerInfo(dd.hosts[0], container)
 		assert.Nil(t, e)
 
 		_ = ipOk(t, dd, "myproject.loc.", address)
@@ -82,7 +83,8 @@ func TestSetupDockerDiscovery(t *testing.T) {
 		_ = ipOk(t, dd, "label-host.loc.", address)
 		_ = ipOk(t, dd, "cservice.cproject.compose.loc.", address)
 
-		containerInfo := ipOk(t, dd, fmt.Sprintf("%s.docker.loc.", container.Name), address)
+		// underscores of container names are sanitized to hyphens
+		containerInfo := ipOk(t, dd, fmt.Sprintf("%s.docker.loc.", strings.ReplaceAll(container.Name, "_", "-")), address)
 		assert.Equal(t, container.Name, containerInfo.container.Name)
 	}
 }
@@ -109,7 +111,7 @@ func TestMultipleNetworksDockerDiscovery(t *testing.T) {
 		IPAddress: expectedAddress.String(),
 	}
 
-	err = dd.updateContainerInfo(container)
+	err = dd.updateContainerInfo(dd.hosts[0], container)
 	assert.Nil(t, err)
 
 	// without label, we expect the "NetworkMode" address to prevail
@@ -118,7 +120,7 @@ func TestMultipleNetworksDockerDiscovery(t *testing.T) {
 	// now, update for the label and try this again
 
 	container.Config.Labels["coredns.dockerdiscovery.network"] = expectedNet
-	err = dd.updateContainerInfo(container)
+	err = dd.updateContainerInfo(dd.hosts[0], container)
 	assert.Nil(t, err)
 
 	_ = ipOk(t, dd, "label-host.loc.", expectedAddress)
@@ -126,12 +128,109 @@ func TestMultipleNetworksDockerDiscovery(t *testing.T) {
 	return
 }
 
+func TestMultipleEndpointsDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker {
+	domain docker.loc
+	endpoint hostA unix:///var/run/docker.sock
+	endpoint hostB tcp://10.0.0.2:2375
+	qualify_hosts
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	assert.Len(t, dd.hosts, 2)
+	assert.Equal(t, "hosta", dd.hosts[0].alias)
+	assert.Equal(t, "tcp://10.0.0.2:2375", dd.hosts[1].endpoint)
+
+	containerA := genContainerDefn("172.17.0.2", "bridge", "172.17.0.2")
+	containerA.Name = "web"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], containerA))
+
+	containerB := genContainerDefn("172.17.0.3", "bridge", "172.17.0.3")
+	containerB.ID = "b" + containerB.ID[1:]
+	containerB.Name = "web"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[1], containerB))
+
+	_ = ipOk(t, dd, "web.hosta.docker.loc.", net.ParseIP("172.17.0.2"))
+	_ = ipOk(t, dd, "web.hostb.docker.loc.", net.ParseIP("172.17.0.3"))
+	ipNotOk(t, dd, "web.docker.loc.")
+
+	c = caddy.NewTestController("dns", `docker unix:///var/run/docker.sock {
+	endpoint hostA tcp://10.0.0.2:2375
+	endpoint hostA tcp://10.0.0.3:2375
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+}
+
+func TestTLSDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker tcp://10.0.0.2:2376 {
+	tls /nonexistent/cert.pem /nonexistent/key.pem /nonexistent/ca.pem
+}`)
+	dd, err := createPlugin(c)
+	assert.NotNil(t, err)
+	assert.Equal(t, "/nonexistent/cert.pem", dd.hosts[0].tlsCert)
+
+	c = caddy.NewTestController("dns", `docker {
+	endpoint remote tcp://10.0.0.2:2376 /nonexistent/cert.pem /nonexistent/key.pem /nonexistent/ca.pem
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+
+	// the default endpoint isn't watched with only endpoint lines
+	c = caddy.NewTestController("dns", `docker {
+	endpoint remote tcp://10.0.0.2:2376
+	tls /nonexistent/cert.pem /nonexistent/key.pem /nonexistent/ca.pem
+}`)
+	_, err = createPlugin(c)
+	assert.ErrorContains(t, err, "tls requires a DOCKER_ENDPOINT argument")
+
+	t.Setenv("DOCKER_HOST", "tcp://10.0.0.2:2375")
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	c = caddy.NewTestController("dns", `docker env`)
+	dd, err = createPlugin(c)
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp://10.0.0.2:2375", dd.hosts[0].client.Endpoint())
+}
+
+func TestTemplateDockerDiscovery(t *testing.T) {
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	template "{{.Labels \"app\"}}.{{.Compose.Project}}.svc.loc,{{.ID}}.id.loc"
+	template "{{.Compose.Service}}.{{.Labels \"missing\"}}.svc.loc {{range .Networks}}{{$.Name}}.{{.}}.net.loc {{end}}"
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+
+	address := net.ParseIP("172.17.0.2")
+	container := genContainerDefn(address.String(), "bridge", address.String())
+	container.Config.Labels["app"] = "shop"
+	assert.Nil(t, dd.updateContainerInfo(dd.hosts[0], container))
+
+	_ = ipOk(t, dd, "shop.cproject.svc.loc.", address)
+	_ = ipOk(t, dd, "fa155d6fd141.id.loc.", address)
+	_ = ipOk(t, dd, "evil-ptolemy.bridge.net.loc.", address)
+	ipNotOk(t, dd, "cservice..svc.loc.")
+
+	c = caddy.NewTestController("dns", `docker {
+	template {{.Name
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+
+	// the lexer would split the template and strip its quotes
+	c = caddy.NewTestController("dns", `docker {
+	template {{.Labels "app"}}.{{.Compose.Project}}.svc.loc
+}`)
+	_, err = createPlugin(c)
+	assert.NotNil(t, err)
+}
+
 // simple check
 func ipOk(t *testing.T, dd *DockerDiscovery, domain string, address net.IP) *ContainerInfo {
 
-	containerInfo, e := dd.containerInfoByDomain(domain)
+	containerInfos, e := dd.containerInfosByDomain(domain)
 	assert.Nil(t, e)
-	assert.NotNil(t, containerInfo)
+	assert.Len(t, containerInfos, 1)
+	containerInfo := containerInfos[0]
 
 	// check as strings here, for us poor mortals
 	assert.Equal(t, address.String(), containerInfo.address.String())
@@ -142,9 +241,9 @@ func ipOk(t *testing.T, dd *DockerDiscovery, domain string, address net.IP) *Con
 // simple check
 func ipNotOk(t *testing.T, dd *DockerDiscovery, domain string) {
 
-	containerInfo, e := dd.containerInfoByDomain(domain)
+	containerInfos, e := dd.containerInfosByDomain(domain)
 	assert.Nil(t, e)
-	assert.Nil(t, containerInfo)
+	assert.Empty(t, containerInfos)
 
 	return
 }
@@ -0,0 +1,138 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+const srvLabelPrefix = "coredns.dockerdiscovery.srv."
+
+const (
+	defaultSRVPriority = 10
+	defaultSRVWeight   = 100
+)
+
+// srvPort is a container port advertised through SRV records
+type srvPort struct {
+	service       string
+	proto         string
+	port          uint16
+	priority      uint16
+	weight        uint16
+	containerPort dockerapi.Port // e.g. 80/tcp
+}
+
+// containerSRVPorts collects the exposed and published ports of the container.
+// The service name defaults to the port number and can be overridden, along
+// with the protocol, priority and weight, by labels such as
+// coredns.dockerdiscovery.srv.80.service=http
+func containerSRVPorts(container *dockerapi.Container) []srvPort {
+	ports := make(map[dockerapi.Port]struct{})
+	if container.Config != nil {
+		for port := range container.Config.ExposedPorts {
+			ports[port] = struct{}{}
+		}
+	}
+	if container.NetworkSettings != nil {
+		for port := range container.NetworkSettings.Ports {
+			ports[port] = struct{}{}
+		}
+	}
+
+	var srvPorts []srvPort
+	for port := range ports {
+		number, err := strconv.ParseUint(port.Port(), 10, 16)
+		if err != nil {
+			log.Printf("[docker] Invalid port %s of container %s", port, container.ID[:12])
+			continue
+		}
+
+		srv := srvPort{
+			service:       port.Port(),
+			proto:         port.Proto(),
+			port:          uint16(number),
+			priority:      defaultSRVPriority,
+			weight:        defaultSRVWeight,
+			containerPort: port,
+		}
+		if err := srv.applyLabels(container.Config, port.Port()); err != nil {
+			log.Printf("[docker] Invalid SRV label of container %s: %s", container.ID[:12], err)
+		}
+		srvPorts = append(srvPorts, srv)
+	}
+
+	sort.Slice(srvPorts, func(i, j int) bool {
+		if srvPorts[i].port != srvPorts[j].port {
+			return srvPorts[i].port < srvPorts[j].port
+		}
+		return srvPorts[i].proto < srvPorts[j].proto
+	})
+	return srvPorts
+}
+
+func (srv *srvPort) applyLabels(config *dockerapi.Config, port string) error {
+	if config == nil {
+		return nil
+	}
+	prefix := srvLabelPrefix + port + "."
+
+	if service, ok := config.Labels[prefix+"service"]; ok {
+		srv.service = service
+	}
+	if proto, ok := config.Labels[prefix+"proto"]; ok {
+		srv.proto = proto
+	}
+	if priority, ok := config.Labels[prefix+"priority"]; ok {
+		value, err := strconv.ParseUint(priority, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%spriority: %s", prefix, err)
+		}
+		srv.priority = uint16(value)
+	}
+	if weight, ok := config.Labels[prefix+"weight"]; ok {
+		value, err := strconv.ParseUint(weight, 10, 16)
+		if err != nil {
+			return fmt.Errorf("%sweight: %s", prefix, err)
+		}
+		srv.weight = uint16(value)
+	}
+	return nil
+}
+
+// splitSRVName splits _service._proto.name into its parts
+func splitSRVName(qname string) (service string, proto string, name string, ok bool) {
+	labels := dns.SplitDomainName(qname)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return "", "", "", false
+	}
+	return labels[0][1:], labels[1][1:], dns.Fqdn(strings.Join(labels[2:], ".")), true
+}
+
+// getSRVAnswer returns the SRV records of the container's ports matching the service and protocol
+func getSRVAnswer(qname string, target string, ports []srvPort, service string, proto string, ttl uint32) []dns.RR {
+	answers := []dns.RR{}
+	for _, port := range ports {
+		if !strings.EqualFold(port.service, service) || !strings.EqualFold(port.proto, proto) {
+			continue
+		}
+		record := new(dns.SRV)
+		record.Hdr = dns.RR_Header{
+			Name:   qname,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		}
+		record.Priority = port.priority
+		record.Weight = port.weight
+		record.Port = port.port
+		record.Target = target
+		answers = append(answers, record)
+	}
+	return answers
+}
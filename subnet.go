@@ -0,0 +1,138 @@
+package dockerdiscovery
+
+import (
+	"net"
+	"sort"
+
+	"github.com/coredns/coredns/request"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+)
+
+// containerNetwork holds the addresses of a container on one of its networks
+type containerNetwork struct {
+	name     string
+	address  net.IP
+	subnet   *net.IPNet
+	address6 net.IP
+	subnet6  *net.IPNet
+}
+
+// containerNetworks returns the addresses of the container on each of its
+// networks, sorted by network name
+func containerNetworks(container *dockerapi.Container) []containerNetwork {
+	if container.NetworkSettings == nil {
+		return nil
+	}
+	var networks []containerNetwork
+	for name, settings := range container.NetworkSettings.Networks {
+		network := containerNetwork{name: name}
+		network.address, network.subnet = parseNetworkAddress(settings.IPAddress, settings.IPPrefixLen, 32)
+		network.address6, network.subnet6 = parseNetworkAddress(settings.GlobalIPv6Address, settings.GlobalIPv6PrefixLen, 128)
+		if network.address != nil || network.address6 != nil {
+			networks = append(networks, network)
+		}
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].name < networks[j].name
+	})
+	return networks
+}
+
+// parseNetworkAddress parses the address and its subnet, nil when unset
+func parseNetworkAddress(address string, prefixLen int, bits int) (net.IP, *net.IPNet) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, nil
+	}
+	if bits == 32 {
+		ip = ip.To4()
+	}
+	if prefixLen <= 0 || prefixLen > bits {
+		return ip, nil
+	}
+	mask := net.CIDRMask(prefixLen, bits)
+	return ip, &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// addressOf returns the IPv4 or IPv6 address and subnet on the network
+func (network containerNetwork) addressOf(v6 bool) (net.IP, *net.IPNet) {
+	if v6 {
+		return network.address6, network.subnet6
+	}
+	return network.address, network.subnet
+}
+
+// subnetOption returns the EDNS client subnet option of the request, nil when
+// there is none or client_subnet isn't enabled
+func (dd *DockerDiscovery) subnetOption(state request.Request) *dns.EDNS0_SUBNET {
+	if !dd.clientSubnet {
+		return nil
+	}
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && subnet.SourceNetmask > 0 {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
+
+// clientAddress returns the address of the client, from its EDNS client subnet
+// option when present. It returns nil when client_subnet isn't enabled.
+func (dd *DockerDiscovery) clientAddress(state request.Request, subnet *dns.EDNS0_SUBNET) net.IP {
+	if !dd.clientSubnet {
+		return nil
+	}
+	if subnet != nil {
+		return subnet.Address
+	}
+	return net.ParseIP(state.IP())
+}
+
+// scopedSubnetOption returns the EDNS client subnet option of the reply: the
+// answer was chosen from the whole source prefix of the client, so it is also
+// the scope of the answer (RFC 7871)
+func scopedSubnetOption(subnet *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		SourceScope:   subnet.SourceNetmask,
+		Address:       subnet.Address,
+	}
+}
+
+// subnetFallbackAddress returns the address on the first of the client_subnet
+// fallback networks the container is connected to, nil when there is none
+func (dd *DockerDiscovery) subnetFallbackAddress(networks []containerNetwork, v6 bool) net.IP {
+	for _, name := range dd.subnetOrder {
+		for _, network := range networks {
+			if address, _ := network.addressOf(v6); network.name == name && address != nil {
+				return address
+			}
+		}
+	}
+	return nil
+}
+
+// clientNetworkAddress returns the address of the container on the network
+// containing the client, falling back to the client_subnet networks order
+// and to the address of the container
+func (dd *DockerDiscovery) clientNetworkAddress(containerInfo *ContainerInfo, client net.IP, v6 bool) net.IP {
+	if client != nil {
+		for _, network := range containerInfo.networks {
+			if address, subnet := network.addressOf(v6); address != nil && subnet != nil && subnet.Contains(client) {
+				return address
+			}
+		}
+		if address := dd.subnetFallbackAddress(containerInfo.networks, v6); address != nil {
+			return address
+		}
+	}
+	if v6 {
+		return containerInfo.address6
+	}
+	return containerInfo.address
+}
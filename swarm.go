@@ -0,0 +1,163 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+const (
+	swarmStackLabel = "com.docker.stack.namespace"
+	swarmTaskLabel  = "com.docker.swarm.task.id"
+)
+
+// swarmRecords maps the canonical swarm service and task domains to their addresses
+type swarmRecords map[string][]net.IP
+
+// swarmServiceDomain returns the domain of the service: <service>.<stack>.<domain>
+// for services deployed by a stack, <service>.<domain> otherwise
+func swarmServiceDomain(service swarm.Service, domain string) string {
+	name := service.Spec.Name
+	if stack, ok := service.Spec.Labels[swarmStackLabel]; ok && stack != "" {
+		name = fmt.Sprintf("%s.%s", strings.TrimPrefix(name, stack+"_"), stack)
+	}
+	return canonicalDomain(fmt.Sprintf("%s.%s", name, domain))
+}
+
+// buildSwarmRecords resolves each service to its virtual IPs, or to the
+// addresses of its running tasks in dnsrr mode, and each task to its own
+// addresses as <slot>.<service domain> (<node id>.<service domain> for global services)
+func buildSwarmRecords(services []swarm.Service, tasks []swarm.Task, domain string) swarmRecords {
+	records := make(swarmRecords)
+
+	ingress := make(map[string]bool)
+	tasksByService := make(map[string][]swarm.Task)
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning {
+			continue
+		}
+		tasksByService[task.ServiceID] = append(tasksByService[task.ServiceID], task)
+		for _, attachment := range task.NetworksAttachments {
+			if attachment.Network.Spec.Ingress {
+				ingress[attachment.Network.ID] = true
+			}
+		}
+	}
+
+	for _, service := range services {
+		serviceDomain := swarmServiceDomain(service, domain)
+
+		var taskAddresses []net.IP
+		for _, task := range tasksByService[service.ID] {
+			var addresses []net.IP
+			for _, attachment := range task.NetworksAttachments {
+				if attachment.Network.Spec.Ingress {
+					continue
+				}
+				addresses = append(addresses, parseCIDRAddresses(attachment.Addresses)...)
+			}
+
+			slot := fmt.Sprintf("%d", task.Slot)
+			if task.Slot == 0 {
+				slot = task.NodeID
+			}
+			records[canonicalDomain(fmt.Sprintf("%s.%s", slot, serviceDomain))] = addresses
+			taskAddresses = append(taskAddresses, addresses...)
+		}
+
+		if service.Spec.EndpointSpec != nil && service.Spec.EndpointSpec.Mode == swarm.ResolutionModeDNSRR {
+			records[serviceDomain] = taskAddresses
+			continue
+		}
+
+		var vips []string
+		for _, vip := range service.Endpoint.VirtualIPs {
+			if !ingress[vip.NetworkID] {
+				vips = append(vips, vip.Addr)
+			}
+		}
+		records[serviceDomain] = parseCIDRAddresses(vips)
+	}
+
+	return records
+}
+
+// parseCIDRAddresses parses addresses in the 10.0.0.2/24 form swarm reports them
+func parseCIDRAddresses(cidrs []string) []net.IP {
+	var addresses []net.IP
+	for _, cidr := range cidrs {
+		address, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			address = net.ParseIP(cidr)
+		}
+		if address != nil {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// isSwarmTaskEvent reports whether the event starts or stops the container of a swarm task
+func isSwarmTaskEvent(msg *dockerapi.APIEvents) bool {
+	return msg.Type == "container" && (msg.Action == "start" || msg.Action == "die") && msg.Actor.Attributes[swarmTaskLabel] != ""
+}
+
+// syncSwarm reloads the swarm services and tasks of the host
+func (dd *DockerDiscovery) syncSwarm(host *dockerHost) error {
+	if dd.swarmDomain == "" {
+		return nil
+	}
+
+	services, err := host.client.ListServices(dockerapi.ListServicesOptions{Context: dd.ctx})
+	if err != nil {
+		return err
+	}
+	tasks, err := host.client.ListTasks(dockerapi.ListTasksOptions{
+		Filters: map[string][]string{"desired-state": {"running"}},
+		Context: dd.ctx,
+	})
+	if err != nil {
+		return err
+	}
+
+	records := buildSwarmRecords(services, tasks, dd.swarmDomain)
+
+	dd.mutex.Lock()
+	defer dd.mutex.Unlock()
+	dd.setSwarmRecords(host, records)
+	dd.serial = uint32(time.Now().Unix())
+	log.Printf("[docker] Loaded %d swarm services and %d tasks from %s", len(services), len(tasks), host.endpoint)
+	return nil
+}
+
+// setSwarmRecords replaces the swarm records of the host. The caller must hold the write lock.
+func (dd *DockerDiscovery) setSwarmRecords(host *dockerHost, records swarmRecords) {
+	for domain := range host.swarmRecords {
+		dd.removeNonTerminals(domain)
+	}
+	host.swarmRecords = records
+	for domain := range host.swarmRecords {
+		dd.addNonTerminals(domain)
+	}
+}
+
+// swarmAddresses returns the A or AAAA addresses of the swarm service or task
+func (dd *DockerDiscovery) swarmAddresses(requestName string, v6 bool) []net.IP {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	var addresses []net.IP
+	for _, host := range dd.hosts {
+		for _, address := range host.swarmRecords[canonicalDomain(requestName)] {
+			if (address.To4() == nil) == v6 {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,139 @@
+package dockerdiscovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/docker/docker/api/types/swarm"
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildSwarmRecords(t *testing.T) {
+	ingress := swarm.NetworkAttachment{
+		Network:   swarm.Network{ID: "ingress", Spec: swarm.NetworkSpec{Ingress: true}},
+		Addresses: []string{"10.0.0.9/24"},
+	}
+	services := []swarm.Service{
+		{
+			ID: "web",
+			Spec: swarm.ServiceSpec{
+				Annotations: swarm.Annotations{Name: "shop_web", Labels: map[string]string{swarmStackLabel: "shop"}},
+			},
+			Endpoint: swarm.Endpoint{VirtualIPs: []swarm.EndpointVirtualIP{
+				{NetworkID: "ingress", Addr: "10.0.0.2/24"},
+				{NetworkID: "overlay", Addr: "10.1.0.2/24"},
+			}},
+		},
+		{
+			ID: "db",
+			Spec: swarm.ServiceSpec{
+				Annotations:  swarm.Annotations{Name: "db"},
+				EndpointSpec: &swarm.EndpointSpec{Mode: swarm.ResolutionModeDNSRR},
+			},
+		},
+	}
+	tasks := []swarm.Task{
+		{
+			ServiceID: "web", Slot: 1, Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{ingress, {Addresses: []string{"10.1.0.5/24"}}},
+		},
+		{
+			ServiceID: "db", Slot: 1, Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"10.1.0.6/24"}}},
+		},
+		{
+			ServiceID: "db", Slot: 2, Status: swarm.TaskStatus{State: swarm.TaskStateRunning},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"10.1.0.7/24"}}},
+		},
+		{
+			ServiceID: "db", Slot: 3, Status: swarm.TaskStatus{State: swarm.TaskStateShutdown},
+			NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"10.1.0.8/24"}}},
+		},
+	}
+
+	records := buildSwarmRecords(services, tasks, "swarm.loc")
+	assert.Len(t, records, 5)
+	assert.Equal(t, "10.1.0.2", records["web.shop.swarm.loc."][0].String())
+	assert.Len(t, records["web.shop.swarm.loc."], 1)
+	assert.Equal(t, "10.1.0.5", records["1.web.shop.swarm.loc."][0].String())
+	assert.Len(t, records["db.swarm.loc."], 2)
+	assert.Equal(t, "10.1.0.7", records["2.db.swarm.loc."][0].String())
+
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	swarm_domain swarm.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	dd.mutex.Lock()
+	dd.setSwarmRecords(dd.hosts[0], records)
+	dd.mutex.Unlock()
+
+	resp := query(t, dd, "db.swarm.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 2)
+
+	resp = query(t, dd, "shop.swarm.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	resp = query(t, dd, "3.db.swarm.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestSwarmTaskEvent(t *testing.T) {
+	services := []swarm.Service{{
+		ID: "db",
+		Spec: swarm.ServiceSpec{
+			Annotations:  swarm.Annotations{Name: "db"},
+			EndpointSpec: &swarm.EndpointSpec{Mode: swarm.ResolutionModeDNSRR},
+		},
+	}}
+	task := swarm.Task{
+		ID: "task", ServiceID: "db", Slot: 1, Status: swarm.TaskStatus{State: swarm.TaskStatePending},
+		NetworksAttachments: []swarm.NetworkAttachment{{Addresses: []string{"10.1.0.6/24"}}},
+	}
+	var mutex sync.Mutex
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.URL.Path {
+		case "/services":
+			_ = json.NewEncoder(w).Encode(services)
+		case "/tasks":
+			_ = json.NewEncoder(w).Encode([]swarm.Task{task})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer daemon.Close()
+
+	c := caddy.NewTestController("dns", `docker unix:///home/user/docker.sock {
+	swarm_domain swarm.loc
+}`)
+	dd, err := createPlugin(c)
+	assert.Nil(t, err)
+	dd.hosts[0].client, err = dockerapi.NewClient(daemon.URL)
+	assert.Nil(t, err)
+
+	// the task of a new service is still pending on the service event
+	dd.handleEvent(dd.hosts[0], &dockerapi.APIEvents{Type: "service", Action: "create", Actor: dockerapi.APIActor{ID: "db"}})
+	resp := query(t, dd, "1.db.swarm.loc.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	mutex.Lock()
+	task.Status.State = swarm.TaskStateRunning
+	mutex.Unlock()
+	dd.handleEvent(dd.hosts[0], &dockerapi.APIEvents{
+		Type: "container", Action: "start",
+		Actor: dockerapi.APIActor{ID: "0123456789abcdef", Attributes: map[string]string{swarmTaskLabel: "task"}},
+	})
+	resp = query(t, dd, "1.db.swarm.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+	resp = query(t, dd, "db.swarm.loc.", dns.TypeA)
+	assert.Len(t, resp.Answer, 1)
+}
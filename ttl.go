@@ -0,0 +1,49 @@
+package dockerdiscovery
+
+import (
+	"log"
+	"strconv"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+const ttlLabel = "coredns.dockerdiscovery.ttl"
+
+// maxTTL is the largest TTL allowed by RFC 2181
+const maxTTL = 1<<31 - 1
+
+// containerTTL returns the TTL of the container records: the value of its
+// ttl label bounded by minTTL and maxTTL, the global TTL without a valid label
+func (dd *DockerDiscovery) containerTTL(container *dockerapi.Container) uint32 {
+	value, ok := container.Config.Labels[ttlLabel]
+	if !ok {
+		return dd.ttl
+	}
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Printf("[docker] Invalid TTL label of container %s: %s", container.ID[:12], err)
+		return dd.ttl
+	}
+	if ttl < uint64(dd.minTTL) {
+		return dd.minTTL
+	}
+	if ttl > uint64(dd.maxTTL) {
+		return dd.maxTTL
+	}
+	return uint32(ttl)
+}
+
+// answerTTL returns the TTL of an RRset of the containers: the lowest one of
+// the containers, the global TTL without containers
+func (dd *DockerDiscovery) answerTTL(containerInfos []*ContainerInfo) uint32 {
+	if len(containerInfos) == 0 {
+		return dd.ttl
+	}
+	ttl := containerInfos[0].ttl
+	for _, containerInfo := range containerInfos[1:] {
+		if containerInfo.ttl < ttl {
+			ttl = containerInfo.ttl
+		}
+	}
+	return ttl
+}
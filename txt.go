@@ -0,0 +1,78 @@
+package dockerdiscovery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTXTLabelPrefix = "coredns.dockerdiscovery.txt."
+
+// maxTXTStringLength is the length limit of a character string of a TXT record
+const maxTXTStringLength = 255
+
+// containerTXT returns the metadata of the container exposed in TXT records:
+// its short ID, image, compose project and service, networks and the labels
+// starting with one of the allowed prefixes, as key=value strings
+func (dd *DockerDiscovery) containerTXT(containerInfo *ContainerInfo) []string {
+	container := containerInfo.container
+	txt := []string{
+		fmt.Sprintf("id=%s", container.ID[:12]),
+		fmt.Sprintf("image=%s", container.Config.Image),
+	}
+	if project, ok := container.Config.Labels["com.docker.compose.project"]; ok {
+		txt = append(txt, fmt.Sprintf("compose_project=%s", project))
+	}
+	if service, ok := container.Config.Labels["com.docker.compose.service"]; ok {
+		txt = append(txt, fmt.Sprintf("compose_service=%s", service))
+	}
+
+	var networks []string
+	for network := range container.NetworkSettings.Networks {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		txt = append(txt, fmt.Sprintf("network=%s", network))
+	}
+
+	var labels []string
+	for label := range container.Config.Labels {
+		for _, prefix := range dd.txtLabelPrefixes {
+			if strings.HasPrefix(label, prefix) {
+				labels = append(labels, label)
+				break
+			}
+		}
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		txt = append(txt, fmt.Sprintf("%s=%s", label, container.Config.Labels[label]))
+	}
+
+	for i, s := range txt {
+		if len(s) > maxTXTStringLength {
+			txt[i] = s[:maxTXTStringLength]
+		}
+	}
+	return txt
+}
+
+// getTXTAnswer returns a TXT record of the metadata of each container
+func (dd *DockerDiscovery) getTXTAnswer(name string, containerInfos []*ContainerInfo) []dns.RR {
+	var answers []dns.RR
+	for _, containerInfo := range containerInfos {
+		record := new(dns.TXT)
+		record.Hdr = dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    dd.answerTTL(containerInfos),
+		}
+		record.Txt = dd.containerTXT(containerInfo)
+		answers = append(answers, record)
+	}
+	return answers
+}
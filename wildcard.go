@@ -0,0 +1,33 @@
+package dockerdiscovery
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// wildcardDomain returns the wildcard domain synthesizing the records of the
+// name as of RFC 4592: *.<closest encloser>, when the name doesn't exist and
+// no name between it and the wildcard does. It returns "" when no wildcard
+// matches. The caller must hold the lock.
+func (dd *DockerDiscovery) wildcardDomain(qname string) string {
+	labels := dns.SplitDomainName(qname)
+
+	// the nearest wildcard first, which is cheap to look up
+	for i := 1; i < len(labels); i++ {
+		wildcard := dns.Fqdn("*." + strings.Join(labels[i:], "."))
+		if _, ok := dd.domainMap[wildcard]; !ok {
+			continue
+		}
+
+		// the closest encloser is the parent of the wildcard only if
+		// neither the name nor a name between them exists
+		for j := 0; j < i; j++ {
+			if dd.nameExists(dns.Fqdn(strings.Join(labels[j:], "."))) {
+				return ""
+			}
+		}
+		return wildcard
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package dockerdiscovery
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const defaultNegativeTTL = 30
+
+// addZone registers a zone the plugin is authoritative for
+func (dd *DockerDiscovery) addZone(zone string) {
+	zone = canonicalDomain(zone)
+	for _, z := range dd.zones {
+		if z == zone {
+			return
+		}
+	}
+	dd.zones = append(dd.zones, zone)
+}
+
+// zoneAnswer answers a query for a name in one of the owned zones that no
+// container record matched: SOA and NS at the zone apex, NODATA when the name
+// exists with other types and NXDOMAIN otherwise
+func (dd *DockerDiscovery) zoneAnswer(state request.Request, zone string) (answers []dns.RR, authority []dns.RR, rcode int) {
+	qname := canonicalDomain(state.Name())
+	soa := dd.soa(zone)
+
+	if qname == zone {
+		switch state.QType() {
+		case dns.TypeSOA:
+			return []dns.RR{soa}, nil, dns.RcodeSuccess
+		case dns.TypeNS:
+			return []dns.RR{dd.ns(zone)}, nil, dns.RcodeSuccess
+		}
+		return nil, []dns.RR{soa}, dns.RcodeSuccess
+	}
+
+	if dd.domainExists(qname) {
+		return nil, []dns.RR{soa}, dns.RcodeSuccess
+	}
+	return nil, []dns.RR{soa}, dns.RcodeNameError
+}
+
+// domainExists reports whether a container resolves to the name, to a name
+// below it or to a wildcard matching it
+func (dd *DockerDiscovery) domainExists(qname string) bool {
+	dd.mutex.RLock()
+	defer dd.mutex.RUnlock()
+
+	return dd.nameExists(qname) || dd.wildcardDomain(qname) != ""
+}
+
+// nameExists reports whether a container or a swarm service resolves to the
+// name or to a name below it. The caller must hold the lock.
+func (dd *DockerDiscovery) nameExists(qname string) bool {
+	if _, ok := dd.domainMap[qname]; ok {
+		return true
+	}
+	if dd.nonTerminals[qname] > 0 {
+		return true
+	}
+	for _, host := range dd.hosts {
+		if _, ok := host.swarmRecords[qname]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addNonTerminals counts the domain in the names above it, so that they
+// exist as empty non-terminals. The caller must hold the write lock.
+func (dd *DockerDiscovery) addNonTerminals(domain string) {
+	offsets := dns.Split(domain)
+	for i := 1; i < len(offsets); i++ {
+		dd.nonTerminals[domain[offsets[i]:]]++
+	}
+}
+
+// removeNonTerminals undoes addNonTerminals. The caller must hold the write lock.
+func (dd *DockerDiscovery) removeNonTerminals(domain string) {
+	offsets := dns.Split(domain)
+	for i := 1; i < len(offsets); i++ {
+		parent := domain[offsets[i]:]
+		dd.nonTerminals[parent]--
+		if dd.nonTerminals[parent] <= 0 {
+			delete(dd.nonTerminals, parent)
+		}
+	}
+}
+
+// soa returns the synthesized SOA record of the zone
+func (dd *DockerDiscovery) soa(zone string) dns.RR {
+	dd.mutex.RLock()
+	serial := dd.serial
+	dd.mutex.RUnlock()
+
+	record := new(dns.SOA)
+	record.Hdr = dns.RR_Header{
+		Name:   zone,
+		Rrtype: dns.TypeSOA,
+		Class:  dns.ClassINET,
+		Ttl:    dd.negativeTTL,
+	}
+	record.Ns = "ns.dns." + zone
+	record.Mbox = "hostmaster." + zone
+	record.Serial = serial
+	record.Refresh = 7200
+	record.Retry = 1800
+	record.Expire = 86400
+	record.Minttl = dd.negativeTTL
+	return record
+}
+
+// ns returns the synthesized NS record of the zone
+func (dd *DockerDiscovery) ns(zone string) dns.RR {
+	record := new(dns.NS)
+	record.Hdr = dns.RR_Header{
+		Name:   zone,
+		Rrtype: dns.TypeNS,
+		Class:  dns.ClassINET,
+		Ttl:    dd.ttl,
+	}
+	record.Ns = "ns.dns." + zone
+	return record
+}